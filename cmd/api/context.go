@@ -9,7 +9,11 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	permissionsContextKey = contextKey("permissions")
+	apiKeyContextKey      = contextKey("apiKey")
+)
 
 // Set the request context to with a key user and the provided user
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -26,3 +30,27 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// Set the permissions carried by a signed access token, saving a lookup
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// Get the permissions from the context, ok is false when they weren't set
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// Set the API key used to authenticate the request
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// Get the API key used to authenticate the request, nil if one wasn't used
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/validator"
+)
+
+// How long a data export, and the token to download it, are kept
+const dataExportTTL = 48 * time.Hour
+
+// Exports are expensive to build, so a new one can only be requested this long after the
+// last
+const dataExportCooldown = 24 * time.Hour
+
+const jobDataExport = "data_export"
+
+type dataExportJob struct {
+	UserID int64 `json:"user_id"`
+}
+
+// Starts building an export of everything stored about the current user. It is
+// generated by a job and the user is emailed a token to download it with. Requests are
+// refused while an export is being built, or for a while after the last one was.
+func (app *application) createDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	job := dataExportJob{UserID: app.contextGetUser(r).ID}
+
+	pending, err := app.jobPending(jobDataExport, job)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if pending {
+		app.conflictResponse(w, r, "a data export is already being prepared")
+		return
+	}
+
+	createdAt, err := app.models.DataExports.GetCreatedAt(job.UserID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	case time.Since(createdAt) < dataExportCooldown:
+		app.tooManyDataExportsResponse(w, r, createdAt.Add(dataExportCooldown))
+		return
+	}
+
+	err = app.enqueueJob(jobDataExport, job)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "an email will be sent to you when your data export is ready"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) dataExportJob(job dataExportJob) error {
+	user, err := app.models.Users.Get(job.UserID)
+	if err != nil {
+		switch {
+		// Nothing to do if the account was deleted in the meantime
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	return app.exportUserData(user)
+}
+
+// Builds and stores the user's archive then emails them a download token, replacing
+// any earlier export
+func (app *application) exportUserData(user *data.User) error {
+	archive, err := app.buildDataExport(user)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.DataExports.Insert(&data.DataExport{
+		UserID:  user.ID,
+		Expiry:  time.Now().Add(dataExportTTL),
+		Archive: archive,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeDataExport, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(user.ID, dataExportTTL, data.ScopeDataExport)
+	if err != nil {
+		return err
+	}
+
+	return app.sendEmail(user.Email, user.Locale, "data_export.tmpl", map[string]any{
+		"dataExportToken": token.Plaintext,
+		"tokenTTL":        dataExportTTL,
+	})
+}
+
+// Assembles a ZIP archive with one JSON file per kind of record
+func (app *application) buildDataExport(user *data.User) ([]byte, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reviews, err := app.models.Reviews.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactor, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The password hash and TOTP secret are never included, the User type doesn't
+	// marshal the hash
+	files := []struct {
+		name     string
+		contents any
+	}{
+		{"user.json", envelope{"user": user, "two_factor_enabled": twoFactor}},
+		{"permissions.json", envelope{"permissions": permissions}},
+		{"roles.json", envelope{"roles": roles}},
+		{"sessions.json", envelope{"sessions": sessions}},
+		{"api_keys.json", envelope{"api_keys": apiKeys}},
+		{"reviews.json", envelope{"reviews": reviews}},
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.contents, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = f.Write(js)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (app *application) tooManyDataExportsResponse(w http.ResponseWriter, r *http.Request, until time.Time) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+
+	message := fmt.Sprintf("a data export was created recently, try again in %d seconds", max(retryAfter, 1))
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// Serves the current user's export. Both the emailed token and the user's own login are
+// required, so neither a leaked email nor a stolen access token is enough on its own.
+// The token is sent in the request body so it stays out of URLs and access logs.
+func (app *application) showDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	owner, err := app.models.Users.GetForToken(data.ScopeDataExport, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired data export token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if owner.ID != user.ID {
+		v.AddError("token", "invalid or expired data export token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	export, err := app.models.DataExports.GetForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.zip"`, user.ID))
+	w.Header().Set("Cache-Control", "no-store")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Archive)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/frankie-mur/greenlight/internal/data"
 	"github.com/frankie-mur/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -17,11 +19,16 @@ import (
 const maxBytes = 1_048_576
 
 func (app *application) readIdParam(r *http.Request) (int64, error) {
+	return app.readInt64Param(r, "id")
+}
+
+// Reads a named path parameter as a positive int64
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
@@ -53,6 +60,82 @@ func (app *application) writeJSON(
 	return nil
 }
 
+// Extracts the token from a "Authorization: Bearer <token>" header. The bool is false
+// if the header is missing or malformed.
+func (app *application) readBearerToken(r *http.Request) (string, bool) {
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return "", false
+	}
+
+	return headerParts[1], true
+}
+
+// Extracts the key from a "Authorization: ApiKey <key>" header
+func (app *application) readAPIKey(r *http.Request) (string, bool) {
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) != 2 || headerParts[0] != "ApiKey" {
+		return "", false
+	}
+
+	return headerParts[1], true
+}
+
+// Returns a strong ETag for a resource with the given version number
+func versionETag(version int32) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// Returns a strong ETag for a movie. Reviews change the rating fields without bumping
+// the movie's version, so they are part of the ETag too.
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d-%d-%s"`, movie.Version, movie.RatingCount, strconv.FormatFloat(movie.AverageRating, 'g', -1, 64))
+}
+
+// Returns a strong ETag for a response envelope by hashing its JSON encoding, this is
+// used for responses (like lists) that aren't a single versioned resource
+func envelopeETag(env envelope) (string, error) {
+	js, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(js)
+	return fmt.Sprintf(`"%x"`, sum[:16]), nil
+}
+
+// Reports whether the etag matches the value of a If-Match or If-None-Match header.
+// If-None-Match uses the weak comparison function, so the W/ prefix is ignored, while
+// If-Match requires a strong match.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sends a 304 Not Modified response, per RFC 9110 this still includes the ETag
+func (app *application) notModifiedResponse(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
+
 // Helpfer function to read json to a dst, if error occurs we match
 // to appropriate client error
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
@@ -160,6 +243,25 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// Returns a bool from string value from the query string, or default value if not provided
+// if the value couldn't be converted to a bool, then we record an
+// error message in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if len(s) == 0 {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
 // Wrapper for a goroutine that recovers from panics
 func (app *application) background(fn func()) {
 	// Start a waitgroup counter, this will allow our background goroutine to finish
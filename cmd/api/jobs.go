@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+)
+
+// How long a worker has to finish a claimed job before it is run again elsewhere
+const jobLease = 10 * time.Minute
+
+// Longest wait between attempts at a job
+const jobMaxRetryDelay = 6 * time.Hour
+
+var (
+	jobsSucceeded = expvar.NewInt("jobs_succeeded")
+	jobsFailed    = expvar.NewInt("jobs_failed")
+	jobsDead      = expvar.NewInt("jobs_dead")
+)
+
+// Everything needed to run jobs of one kind. The attempts and backoff are stored with
+// each job when it's queued.
+type jobKind struct {
+	run         func(payload json.RawMessage) error
+	maxAttempts int
+	backoff     time.Duration
+}
+
+type jobRegistry map[string]jobKind
+
+// Register the handler for jobs of a kind. The job's payload is decoded into a T before
+// fn is called, a job which fails is retried with an exponential backoff starting at
+// backoff until it has been attempted maxAttempts times.
+func registerJob[T any](app *application, kind string, maxAttempts int, backoff time.Duration, fn func(T) error) {
+	if _, exists := app.jobs[kind]; exists {
+		panic(fmt.Sprintf("job kind %q registered twice", kind))
+	}
+
+	app.jobs[kind] = jobKind{
+		run: func(payload json.RawMessage) error {
+			var input T
+
+			err := json.Unmarshal(payload, &input)
+			if err != nil {
+				return fmt.Errorf("decoding %s job payload: %w", kind, err)
+			}
+
+			return fn(input)
+		},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+}
+
+// All the kinds of job the application runs
+func (app *application) registerJobs() {
+	registerJob(app, jobDataExport, 3, time.Minute, app.dataExportJob)
+}
+
+// Queue a job to run as soon as a worker is free
+func (app *application) enqueueJob(kind string, payload any) error {
+	return app.scheduleJob(kind, payload, 0, time.Time{})
+}
+
+// Reports whether a job of the kind with the same payload is already queued
+func (app *application) jobPending(kind string, payload any) (bool, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+
+	return app.models.Jobs.ExistsPending(kind, js)
+}
+
+// Queue a job to run at runAt, higher priority jobs run first once they are due
+func (app *application) scheduleJob(kind string, payload any, priority int, runAt time.Time) error {
+	k, ok := app.jobs[kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Jobs.Insert(&data.Job{
+		Kind:        kind,
+		Payload:     js,
+		Priority:    priority,
+		MaxAttempts: k.maxAttempts,
+		Backoff:     k.backoff,
+		RunAt:       runAt,
+	})
+}
+
+// Start the job workers, they stop once the application shuts down. Jobs still queued
+// at that point stay in the database for the next start.
+func (app *application) startJobWorkers() {
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.wg.Add(1)
+		go app.jobWorker()
+	}
+}
+
+func (app *application) jobWorker() {
+	defer app.wg.Done()
+
+	for {
+		job, err := app.models.Jobs.Claim(jobLease)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		if job != nil {
+			app.finishJob(job, app.runJob(job))
+		}
+
+		//Only wait when the queue looked empty, otherwise go straight on to the next job
+		wait := app.config.jobs.pollInterval
+		if job != nil {
+			wait = 0
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Run a job's handler, a panic counts as a failure
+func (app *application) runJob(job *data.Job) (err error) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			err = fmt.Errorf("panic: %v", pv)
+		}
+	}()
+
+	k, ok := app.jobs[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler registered for job kind %q", job.Kind)
+	}
+
+	return k.run(job.Payload)
+}
+
+// Record the outcome of a job, retrying failures until they run out of attempts
+func (app *application) finishJob(job *data.Job, jobErr error) {
+	var err error
+
+	switch {
+	case jobErr == nil:
+		jobsSucceeded.Add(1)
+		err = app.models.Jobs.MarkDone(job.ID)
+	case job.Attempts >= job.MaxAttempts:
+		jobsFailed.Add(1)
+		jobsDead.Add(1)
+		app.logger.Error("job failed for the last time", "id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", jobErr.Error())
+		err = app.models.Jobs.MarkDead(job.ID, jobErr.Error())
+	default:
+		jobsFailed.Add(1)
+		app.logger.Warn("job failed", "id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", jobErr.Error())
+		retryAt := time.Now().Add(backoffDelay(job.Backoff, jobMaxRetryDelay, job.Attempts))
+		err = app.models.Jobs.MarkFailed(job.ID, jobErr.Error(), retryAt)
+	}
+
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// The delay after a number of failed attempts, doubling from base each time up to limit
+func backoffDelay(base, limit time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= limit {
+			return limit
+		}
+	}
+
+	return delay
+}
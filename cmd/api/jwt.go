@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/jwt"
+)
+
+// The claims carried by signed access tokens. Everything authenticate needs is in the
+// token so requests don't touch the database.
+type accessClaims struct {
+	Subject     string           `json:"sub"`
+	IssuedAt    int64            `json:"iat"`
+	IssuedAtMs  int64            `json:"iat_ms"`
+	ExpiresAt   int64            `json:"exp"`
+	ID          string           `json:"jti"`
+	Session     string           `json:"sid"`
+	Activated   bool             `json:"act"`
+	Permissions data.Permissions `json:"perms"`
+}
+
+// A -jwt-key flag value, in the form kid:alg:path
+type jwtKeyFlag struct {
+	id   string
+	alg  string
+	path string
+}
+
+func parseJWTKeyFlag(val string) (jwtKeyFlag, error) {
+	parts := strings.SplitN(val, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return jwtKeyFlag{}, fmt.Errorf("invalid key %q, expected kid:alg:path", val)
+	}
+
+	return jwtKeyFlag{id: parts[0], alg: parts[1], path: parts[2]}, nil
+}
+
+// Load the configured keys, signing with -jwt-signing-key or else the first key given
+func loadKeyring(cfg config) (*jwt.Keyring, error) {
+	if len(cfg.auth.jwtKeys) == 0 {
+		return nil, fmt.Errorf("-auth-mode=jwt requires at least one -jwt-key")
+	}
+
+	keys := make([]*jwt.Key, 0, len(cfg.auth.jwtKeys))
+
+	for _, k := range cfg.auth.jwtKeys {
+		key, err := jwt.LoadKey(k.id, k.alg, k.path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	signingID := cfg.auth.jwtSigningKey
+	if signingID == "" {
+		signingID = keys[0].ID
+	}
+
+	return jwt.NewKeyring(signingID, keys...)
+}
+
+// Signed access tokens are used when a keyring is configured, the database issues access
+// tokens otherwise. Returns the access token lifetime to request from the token model.
+func (app *application) storedAccessTTL() time.Duration {
+	if app.keyring != nil {
+		return 0
+	}
+
+	return app.config.tokens.accessTTL
+}
+
+// In signed mode, fills in the pair's access token with a signed one for the same session
+func (app *application) signAccessToken(pair *data.TokenPair, activated bool) error {
+	if app.keyring == nil {
+		return nil
+	}
+
+	userID := pair.Refresh.UserID
+
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	jti := make([]byte, 16)
+	_, err = rand.Read(jti)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.accessTTL)
+
+	claims := accessClaims{
+		Subject:     strconv.FormatInt(userID, 10),
+		IssuedAt:    now.Unix(),
+		IssuedAtMs:  now.UnixMilli(),
+		ExpiresAt:   expiry.Unix(),
+		ID:          base64.RawURLEncoding.EncodeToString(jti),
+		Session:     base64.RawURLEncoding.EncodeToString(pair.Refresh.Family),
+		Activated:   activated,
+		Permissions: permissions,
+	}
+
+	signed, err := app.keyring.Sign(claims)
+	if err != nil {
+		return err
+	}
+
+	pair.Access = &data.Token{
+		Plaintext: signed,
+		UserID:    userID,
+		Expiry:    time.Unix(claims.ExpiresAt, 0),
+		Scope:     data.ScopeAuthentication,
+	}
+
+	return nil
+}
+
+// Reports whether the bearer token is a signed access token rather than a stored one.
+// Stored tokens are base32 so never contain a dot.
+func (app *application) isSignedToken(token string) bool {
+	return app.keyring != nil && strings.Count(token, ".") == 2
+}
+
+// Verify a signed access token, including checking it hasn't been revoked
+func (app *application) parseSignedToken(token string) (*accessClaims, error) {
+	var claims accessClaims
+
+	err := app.keyring.Verify(token, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		return nil, jwt.ErrInvalidToken
+	}
+
+	if app.revocations.revoked(userID, claims.issuedAt()) {
+		return nil, jwt.ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// When the token was issued, to the millisecond. iat only has second precision, so tokens
+// without iat_ms are taken to be issued at the end of that second.
+func (c *accessClaims) issuedAt() time.Time {
+	if c.IssuedAtMs == 0 {
+		return time.Unix(c.IssuedAt, 0).Add(time.Second - time.Millisecond)
+	}
+
+	return time.UnixMilli(c.IssuedAtMs)
+}
+
+func (c *accessClaims) userID() int64 {
+	id, _ := strconv.ParseInt(c.Subject, 10, 64)
+	return id
+}
+
+func (c *accessClaims) family() []byte {
+	family, _ := base64.RawURLEncoding.DecodeString(c.Session)
+	return family
+}
+
+// Revoke every signed access token issued to the user so far. Clients then need to use
+// their refresh token, which picks up any change to the user's permissions.
+func (app *application) revokeSignedTokens(userID int64) error {
+	if app.keyring == nil {
+		return nil
+	}
+
+	validAfter, err := app.models.Users.RevokeSignedTokens(userID)
+	if err != nil {
+		return err
+	}
+
+	app.revocations.set(userID, validAfter)
+
+	return nil
+}
+
+// Apply revocations already written to the database to this instance straight away,
+// rather than waiting for the next poll
+func (app *application) setRevocations(userIDs []int64, validAfter time.Time) {
+	if app.keyring == nil {
+		return
+	}
+
+	for _, userID := range userIDs {
+		app.revocations.set(userID, validAfter)
+	}
+}
+
+// revocationList mirrors users.tokens_valid_after for recently revoked users, so signed
+// tokens can be checked without a query. It is kept in sync by polling, changes made
+// through another instance apply within one poll interval.
+type revocationList struct {
+	mu         sync.RWMutex
+	validAfter map[int64]time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{validAfter: make(map[int64]time.Time)}
+}
+
+// Tokens issued in the same millisecond as the revocation are treated as revoked, since
+// that is the precision of iat_ms
+func (l *revocationList) revoked(userID int64, issuedAt time.Time) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	validAfter, ok := l.validAfter[userID]
+	return ok && !issuedAt.After(validAfter.Truncate(time.Millisecond))
+}
+
+func (l *revocationList) set(userID int64, validAfter time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if validAfter.After(l.validAfter[userID]) {
+		l.validAfter[userID] = validAfter
+	}
+}
+
+// Load revocations recent enough to affect unexpired tokens, and forget older ones
+func (app *application) refreshRevocations() error {
+	// Allow some slack for clock differences between the database and this server
+	cutoff := time.Now().Add(-app.config.tokens.accessTTL - time.Minute)
+
+	validAfter, err := app.models.Users.GetTokensValidAfter(cutoff)
+	if err != nil {
+		return err
+	}
+
+	l := app.revocations
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for userID, t := range l.validAfter {
+		if t.Before(cutoff) {
+			delete(l.validAfter, userID)
+		}
+	}
+
+	for userID, t := range validAfter {
+		if t.After(l.validAfter[userID]) {
+			l.validAfter[userID] = t
+		}
+	}
+
+	return nil
+}
+
+func (app *application) pollRevocations() {
+	for {
+		time.Sleep(app.config.auth.revocationPollInterval)
+
+		err := app.refreshRevocations()
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+}
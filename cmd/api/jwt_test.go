@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevocationListRevoked(t *testing.T) {
+	validAfter := time.Date(2026, 3, 4, 10, 0, 0, 500_400_000, time.UTC)
+
+	l := newRevocationList()
+	l.set(1, validAfter)
+
+	tests := []struct {
+		name     string
+		userID   int64
+		issuedAt time.Time
+		want     bool
+	}{
+		{"issued before", 1, validAfter.Add(-time.Minute), true},
+		{"issued earlier in the same millisecond", 1, validAfter.Add(-400 * time.Microsecond), true},
+		{"issued the millisecond truncated to", 1, validAfter.Truncate(time.Millisecond), true},
+		{"issued the next millisecond", 1, validAfter.Truncate(time.Millisecond).Add(time.Millisecond), false},
+		{"issued later in the same second", 1, validAfter.Add(100 * time.Millisecond), false},
+		{"other user", 2, validAfter.Add(-time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.revoked(tt.userID, tt.issuedAt); got != tt.want {
+				t.Errorf("revoked = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevocationListSetKeepsLatest(t *testing.T) {
+	later := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	l := newRevocationList()
+	l.set(1, later)
+	l.set(1, later.Add(-time.Hour))
+
+	if !l.revoked(1, later.Add(-time.Minute)) {
+		t.Error("an older revocation replaced a newer one")
+	}
+}
+
+func TestAccessClaimsIssuedAt(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims accessClaims
+		want   time.Time
+	}{
+		{"milliseconds", accessClaims{IssuedAt: 1772618400, IssuedAtMs: 1772618400123}, time.UnixMilli(1772618400123)},
+		{"seconds only", accessClaims{IssuedAt: 1772618400}, time.UnixMilli(1772618400999)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.claims.issuedAt(); !got.Equal(tt.want) {
+				t.Errorf("issuedAt = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/tomasen/realip"
+)
+
+// The backoff applied to failed logins for an account or IP address, IP addresses get
+// more attempts since they can be shared
+func (app *application) loginPolicy(kind string) data.LockoutPolicy {
+	freeAttempts := app.config.login.freeAttempts
+	if kind == data.LoginThrottleIP {
+		freeAttempts = app.config.login.ipFreeAttempts
+	}
+
+	return data.LockoutPolicy{
+		FreeAttempts: freeAttempts,
+		BaseDelay:    app.config.login.backoffBase,
+		MaxDelay:     app.config.login.lockout,
+		Window:       app.config.login.failureWindow,
+	}
+}
+
+// Refuses the request with a 429 if logins for the subject are currently throttled.
+// Returns false when a response has been written.
+func (app *application) checkLoginThrottle(w http.ResponseWriter, r *http.Request, kind, subject string) bool {
+	throttle, err := app.models.LoginThrottles.Get(kind, subject)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if throttle.Locked() {
+		app.tooManyLoginAttemptsResponse(w, r, *throttle.LockedUntil)
+		return false
+	}
+
+	return true
+}
+
+// Counts a failed login against the request's IP address and, if known, the account.
+// The account owner is emailed when the failure locks their account.
+func (app *application) recordLoginFailure(r *http.Request, user *data.User) error {
+	ip := realip.FromRequest(r)
+
+	_, err := app.models.LoginThrottles.RecordFailure(data.LoginThrottleIP, ip, app.loginPolicy(data.LoginThrottleIP))
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	policy := app.loginPolicy(data.LoginThrottleAccount)
+
+	throttle, err := app.models.LoginThrottles.RecordFailure(data.LoginThrottleAccount, data.AccountSubject(user.ID), policy)
+	if err != nil {
+		return err
+	}
+
+	if policy.LockedOut(throttle.Failures) {
+		app.logger.Warn("account locked after failed logins", "user_id", user.ID, "ip", ip)
+
+		lockedUntil := throttle.LockedUntil.UTC().Format(time.RFC1123)
+
+		err = app.sendEmail(user.Email, user.Locale, "account_locked.tmpl", map[string]any{
+			"ipAddress":   ip,
+			"lockedUntil": lockedUntil,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Logins from an IP shared with an attacker still count against it, so only the account
+// is cleared on success
+func (app *application) recordLoginSuccess(user *data.User) error {
+	return app.models.LoginThrottles.Reset(data.LoginThrottleAccount, data.AccountSubject(user.ID))
+}
+
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, until time.Time) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+
+	message := fmt.Sprintf("too many failed login attempts, try again in %d seconds", max(retryAfter, 1))
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// Lists the accounts and IP addresses currently refused logins
+func (app *application) listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	throttles, err := app.models.LoginThrottles.GetAllLocked()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockouts": throttles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserFromParam(w, r)
+	if !ok {
+		return
+	}
+
+	throttle, err := app.models.LoginThrottles.Get(data.LoginThrottleAccount, data.AccountSubject(user.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"lockout": throttle,
+		"locked":  throttle.Locked(),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Clears a user's failed logins, unlocking their account
+func (app *application) resetUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserFromParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.LoginThrottles.Reset(data.LoginThrottleAccount, data.AccountSubject(user.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account lockout cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
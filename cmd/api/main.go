@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"expvar"
 	"flag"
@@ -15,7 +17,9 @@ import (
 	"time"
 
 	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/jwt"
 	"github.com/frankie-mur/greenlight/internal/mailer"
+	"github.com/frankie-mur/greenlight/internal/passhash"
 	"github.com/frankie-mur/greenlight/internal/vcs"
 	_ "github.com/lib/pq"
 )
@@ -32,12 +36,18 @@ type config struct {
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  time.Duration
+
+		allowPendingMigrations bool
 	}
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
 	}
+	mail struct {
+		transport string
+		dir       string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -49,6 +59,57 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	cursor struct {
+		secret []byte
+	}
+	authCache struct {
+		enabled bool
+		size    int
+		ttl     time.Duration
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	login struct {
+		freeAttempts   int
+		ipFreeAttempts int
+		backoffBase    time.Duration
+		lockout        time.Duration
+		failureWindow  time.Duration
+	}
+	auth struct {
+		mode                   string
+		jwtKeys                []jwtKeyFlag
+		jwtSigningKey          string
+		revocationPollInterval time.Duration
+	}
+	scheduler struct {
+		purgeTokens      string
+		purgeExports     string
+		purgeUnactivated string
+		vacuum           string
+		unactivatedDays  int
+		historyRetention time.Duration
+	}
+	jobs struct {
+		workers      int
+		pollInterval time.Duration
+	}
+	outbox struct {
+		workers      int
+		pollInterval time.Duration
+		maxAttempts  int
+		retryBase    time.Duration
+		secret       []byte
+	}
+	passwords struct {
+		hasher            string
+		argon2Memory      int
+		argon2Iterations  int
+		argon2Parallelism int
+		bcryptCost        int
+	}
 }
 
 type application struct {
@@ -57,6 +118,19 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+
+	//Closed when the server starts shutting down, so long running workers stop
+	shutdown chan struct{}
+
+	//Handlers for each kind of background job
+	jobs jobRegistry
+
+	//Maintenance tasks run by the scheduler
+	tasks []*scheduledTask
+
+	//Only set when signed access tokens are enabled (-auth-mode=jwt)
+	keyring     *jwt.Keyring
+	revocations *revocationList
 }
 
 func main() {
@@ -70,10 +144,14 @@ func main() {
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	flag.BoolVar(&cfg.db.allowPendingMigrations, "db-allow-pending-migrations", false, "Start the server even if the database schema is behind")
 	//Rate Limiter settings
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	//Mail delivery settings
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "How emails are delivered (smtp|file|log)")
+	flag.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Directory emails are written to as .eml files, when -mail-transport=file")
 	//SMPT server settings
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
@@ -86,6 +164,62 @@ func main() {
 		return nil
 	})
 
+	//Authentication cache settings
+	flag.BoolVar(&cfg.authCache.enabled, "auth-cache-enabled", true, "Cache token and permission lookups in memory")
+	flag.IntVar(&cfg.authCache.size, "auth-cache-size", 10_000, "Maximum number of entries in each authentication cache")
+	flag.DurationVar(&cfg.authCache.ttl, "auth-cache-ttl", time.Minute, "How long authentication cache entries live (changes made via other instances can take this long to apply)")
+	//Token lifetime settings
+	flag.DurationVar(&cfg.tokens.accessTTL, "token-access-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Lifetime of refresh tokens, each refresh issues a new one")
+	//Login brute-force protection settings
+	flag.IntVar(&cfg.login.freeAttempts, "login-free-attempts", 3, "Failed logins allowed per account before backoff starts")
+	flag.IntVar(&cfg.login.ipFreeAttempts, "login-ip-free-attempts", 20, "Failed logins allowed per IP address before backoff starts")
+	flag.DurationVar(&cfg.login.backoffBase, "login-backoff-base", time.Second, "Initial login backoff, doubled with each further failure")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout-duration", 15*time.Minute, "Maximum login backoff, reaching it locks the account and emails the user")
+	flag.DurationVar(&cfg.login.failureWindow, "login-failure-window", 24*time.Hour, "How long failed logins are remembered")
+	//Access token mode settings
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "database", "How access tokens are issued (database|jwt)")
+	flag.Func("jwt-key", "Key used for signed access tokens as kid:alg:path, alg is HS256 or EdDSA (repeatable)", func(val string) error {
+		key, err := parseJWTKeyFlag(val)
+		if err != nil {
+			return err
+		}
+		cfg.auth.jwtKeys = append(cfg.auth.jwtKeys, key)
+		return nil
+	})
+	flag.StringVar(&cfg.auth.jwtSigningKey, "jwt-signing-key", "", "kid of the key used to sign new access tokens (defaults to the first -jwt-key)")
+	flag.DurationVar(&cfg.auth.revocationPollInterval, "jwt-revocation-poll-interval", 10*time.Second, "How often revoked signed tokens are reloaded from the database")
+	//Scheduled task settings
+	flag.StringVar(&cfg.scheduler.purgeTokens, "schedule-purge-tokens", "@hourly", "Cron schedule for deleting expired tokens, or off")
+	flag.StringVar(&cfg.scheduler.purgeExports, "schedule-purge-exports", "@hourly", "Cron schedule for deleting expired data exports, or off")
+	flag.StringVar(&cfg.scheduler.purgeUnactivated, "schedule-purge-unactivated", "@daily", "Cron schedule for deleting accounts never activated, or off")
+	flag.StringVar(&cfg.scheduler.vacuum, "schedule-vacuum", "@daily", "Cron schedule for deleting old email, job and scheduled run history, or off")
+	flag.IntVar(&cfg.scheduler.unactivatedDays, "unactivated-account-days", 30, "Days after which accounts that were never activated are deleted")
+	flag.DurationVar(&cfg.scheduler.historyRetention, "history-retention", 30*24*time.Hour, "How long sent emails, finished jobs and scheduled runs are kept")
+	//Background job settings
+	flag.IntVar(&cfg.jobs.workers, "job-workers", 4, "Number of workers running background jobs")
+	flag.DurationVar(&cfg.jobs.pollInterval, "job-poll-interval", time.Second, "How often idle job workers check for new jobs")
+	//Email outbox settings
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of workers sending queued emails")
+	flag.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", time.Second, "How often idle outbox workers check for new emails")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Attempts to send an email before it is marked dead")
+	flag.DurationVar(&cfg.outbox.retryBase, "outbox-retry-base", 30*time.Second, "Delay before retrying a failed email, doubled with each further failure")
+	flag.Func("outbox-secret", "Secret used to encrypt the data of queued emails (random per process if not set, required in production)", func(val string) error {
+		cfg.outbox.secret = []byte(val)
+		return nil
+	})
+	//Password hashing settings
+	flag.StringVar(&cfg.passwords.hasher, "password-hasher", "argon2id", "Algorithm used to hash new passwords, existing hashes are upgraded on login (argon2id|bcrypt)")
+	flag.IntVar(&cfg.passwords.argon2Memory, "argon2-memory", int(passhash.DefaultArgon2Params.Memory), "Argon2id memory cost in KiB")
+	flag.IntVar(&cfg.passwords.argon2Iterations, "argon2-iterations", int(passhash.DefaultArgon2Params.Iterations), "Argon2id number of passes")
+	flag.IntVar(&cfg.passwords.argon2Parallelism, "argon2-parallelism", int(passhash.DefaultArgon2Params.Parallelism), "Argon2id number of threads")
+	flag.IntVar(&cfg.passwords.bcryptCost, "bcrypt-cost", 12, "Bcrypt cost, when -password-hasher=bcrypt")
+	//Pagination cursor settings
+	flag.Func("cursor-secret", "Secret used to sign pagination cursors (random per process if not set)", func(val string) error {
+		cfg.cursor.secret = []byte(val)
+		return nil
+	})
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -100,6 +234,45 @@ func main() {
 	// Init our slog logger that writes to standard out
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	// Without a configured secret generate one, cursors then only remain valid for the
+	// lifetime of this process (and aren't shared between instances).
+	if len(cfg.cursor.secret) == 0 {
+		cfg.cursor.secret = make([]byte, 32)
+		_, err := rand.Read(cfg.cursor.secret)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		logger.Warn("no -cursor-secret provided, using a random pagination cursor secret")
+	}
+
+	// Same for the outbox secret, except that emails queued by another process can't be
+	// sent by this one and end up dead. That would lose mail on every restart, so
+	// production has to set one.
+	if len(cfg.outbox.secret) == 0 {
+		if cfg.env == "production" {
+			logger.Error("-outbox-secret must be provided in production")
+			os.Exit(1)
+		}
+
+		cfg.outbox.secret = make([]byte, 32)
+		_, err := rand.Read(cfg.outbox.secret)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		logger.Warn("no -outbox-secret provided, using a random outbox secret")
+	}
+	emailDataKey := sha256.Sum256(cfg.outbox.secret)
+	data.EmailDataKey = emailDataKey[:]
+
+	passwordHasher, err := newPasswordHasher(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	data.PasswordHasher = passwordHasher
+
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application immediately.
@@ -117,6 +290,25 @@ func main() {
 	// established.
 	logger.Info("database connection pool established")
 
+	// `api migrate ...` applies the embedded migrations and exits rather than starting
+	// the server.
+	if flag.Arg(0) == "migrate" {
+		err = runMigrate(db, flag.Args()[1:])
+		if err != nil {
+			logger.Error(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = checkMigrations(db, cfg.db.allowPendingMigrations)
+	if err != nil {
+		logger.Error(err.Error())
+		db.Close()
+		os.Exit(1)
+	}
+
 	// Setup for expvar metrics
 	expvar.NewString("version").Set(version)
 	// Publish the number of active goroutines.
@@ -129,19 +321,83 @@ func main() {
 		return db.Stats()
 	}))
 
+	// Only create the authentication cache if enabled, the models treat a nil cache as
+	// disabled.
+	var authCache *data.AuthCache
+	if cfg.authCache.enabled {
+		authCache = data.NewAuthCache(cfg.authCache.size, cfg.authCache.ttl)
+	}
+
+	// Publish the authentication cache hit and miss counters.
+	expvar.Publish("auth_cache", expvar.Func(func() any {
+		return authCache.Stats()
+	}))
+
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	mailTransport, err := newMailTransport(cfg, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	// Declare our application struct
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		models: data.NewModels(db, authCache),
+		mailer: mailer.New(mailTransport, cfg.smtp.sender),
+
+		shutdown: make(chan struct{}),
+		jobs:     make(jobRegistry),
+	}
+
+	app.registerJobs()
+
+	app.tasks, err = app.scheduledTasks()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Publish the number of queued jobs.
+	expvar.Publish("jobs", expvar.Func(func() any {
+		counts, err := app.models.Jobs.Counts()
+		if err != nil {
+			return nil
+		}
+		return counts
+	}))
+
+	// In jwt mode access tokens are verified locally, only revocations are loaded from
+	// the database.
+	switch cfg.auth.mode {
+	case "database":
+	case "jwt":
+		app.keyring, err = loadKeyring(cfg)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		app.revocations = newRevocationList()
+		err = app.refreshRevocations()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		go app.pollRevocations()
+	default:
+		logger.Error(fmt.Sprintf("unknown -auth-mode %q", cfg.auth.mode))
+		os.Exit(1)
 	}
 
+	app.startEmailWorkers()
+	app.startJobWorkers()
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -149,6 +405,45 @@ func main() {
 	}
 }
 
+// Create the mail transport chosen with -mail-transport. The file and log transports
+// make local development possible without a mail server.
+func newMailTransport(cfg config, logger *slog.Logger) (mailer.Transport, error) {
+	switch cfg.mail.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileTransport(cfg.mail.dir)
+	case "log":
+		return mailer.NewLogTransport(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown -mail-transport %q", cfg.mail.transport)
+	}
+}
+
+// Create the hasher for new passwords from the -password-hasher and related flags
+func newPasswordHasher(cfg config) (passhash.Hasher, error) {
+	switch cfg.passwords.hasher {
+	case "argon2id":
+		if cfg.passwords.argon2Parallelism < 1 || cfg.passwords.argon2Parallelism > 255 {
+			return nil, fmt.Errorf("-argon2-parallelism must be between 1 and 255")
+		}
+		if cfg.passwords.argon2Memory < 1 || cfg.passwords.argon2Iterations < 1 {
+			return nil, fmt.Errorf("-argon2-memory and -argon2-iterations must be positive")
+		}
+
+		params := passhash.DefaultArgon2Params
+		params.Memory = uint32(cfg.passwords.argon2Memory)
+		params.Iterations = uint32(cfg.passwords.argon2Iterations)
+		params.Parallelism = uint8(cfg.passwords.argon2Parallelism)
+
+		return passhash.NewArgon2id(params)
+	case "bcrypt":
+		return passhash.NewBcrypt(cfg.passwords.bcryptCost)
+	default:
+		return nil, fmt.Errorf("unknown -password-hasher %q", cfg.passwords.hasher)
+	}
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config
 	// struct.
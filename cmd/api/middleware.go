@@ -1,10 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -113,8 +114,34 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// How often a session's last_used_at is written, so that busy clients don't cause a
+// database write on every request
+const sessionTouchInterval = time.Minute
+
 // Middleware is used to authenticate an auth token in headers
 func (app *application) authenticate(next http.Handler) http.Handler {
+	//Track when each token last had its last_used_at updated. Sessions are keyed by the
+	//token hash and API keys by id, so plaintext tokens aren't kept around in memory.
+	var (
+		mu          sync.Mutex
+		lastTouched = make(map[string]time.Time)
+	)
+
+	//Go routine to remove entries which no longer throttle anything
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			mu.Lock()
+			for key, touched := range lastTouched {
+				if time.Since(touched) > sessionTouchInterval {
+					delete(lastTouched, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		//Set Vary header for any cache
 		r.Header.Set("Vary", "Authorization")
@@ -130,15 +157,68 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		//Validate the authorization header
-		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		//API keys authenticate as their owner, with only the key's permissions
+		if key, ok := app.readAPIKey(r); ok {
+			user, apiKey, err := app.models.APIKeys.GetForKey(key)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAPIKeyResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			//Update the key's last used time, at most once per interval
+			touchKey := fmt.Sprintf("api_key:%d", apiKey.ID)
+
+			mu.Lock()
+			touch := time.Since(lastTouched[touchKey]) > sessionTouchInterval
+			if touch {
+				lastTouched[touchKey] = time.Now()
+			}
+			mu.Unlock()
+
+			if touch {
+				app.background(func() {
+					err := app.models.APIKeys.Touch(apiKey.ID)
+					if err != nil {
+						app.logger.Error(err.Error())
+					}
+				})
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, apiKey.Permissions)
+			r = app.contextSetAPIKey(r, apiKey)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//Validate the authorization header and extract the token
+		token, ok := app.readBearerToken(r)
+		if !ok {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		//extract the token
-		token := headerParts[1]
+		//Signed tokens are verified without the database. The user then only has the
+		//fields carried by the token (id and activation state)
+		if app.isSignedToken(token) {
+			claims, err := app.parseSignedToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, &data.User{ID: claims.userID(), Activated: claims.Activated})
+			r = app.contextSetPermissions(r, claims.Permissions)
+
+			next.ServeHTTP(w, r)
+			return
+		}
 
 		//retrieve the user matching the given token
 		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
@@ -151,6 +231,27 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+
+		//Update the session's last used time, at most once per interval
+		tokenHash := sha256.Sum256([]byte(token))
+		touchKey := hex.EncodeToString(tokenHash[:])
+
+		mu.Lock()
+		touch := time.Since(lastTouched[touchKey]) > sessionTouchInterval
+		if touch {
+			lastTouched[touchKey] = time.Now()
+		}
+		mu.Unlock()
+
+		if touch {
+			app.background(func() {
+				err := app.models.Tokens.Touch(token)
+				if err != nil {
+					app.logger.Error(err.Error())
+				}
+			})
+		}
+
 		//Add user to the request context
 		r = app.contextSetUser(r, user)
 
@@ -191,16 +292,35 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// Checks that the request wasn't authenticated with an API key, for endpoints that
+// manage credentials and so need a real login
+func (app *application) requireNoAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		//Get the user from the request context
 		user := app.contextGetUser(r)
 
-		//Get the permissions of the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		//Get the permissions of the user, signed tokens carry them already
+		permissions, ok := app.contextGetPermissions(r)
+		if !ok {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 
 		//Check that user has required permissions
@@ -230,6 +350,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for _, val := range app.config.cors.trustedOrigins {
 				if reqOrigin == val {
 					r.Header.Set("Access-Control-Allow-Origin", reqOrigin)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
@@ -237,7 +358,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						// Set the necessary preflight response headers
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
 
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/frankie-mur/greenlight/internal/migrate"
+	"github.com/frankie-mur/greenlight/migrations"
+)
+
+const migrateUsage = "usage: api [flags] migrate up [N] | down [N] | status | goto VERSION"
+
+// Handle the `migrate` subcommand, applying the migrations embedded in the binary
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// Optional step count for up and down, all remaining steps if not provided for up
+	// and a single step for down
+	steps := 0
+	if len(args) > 1 && (args[0] == "up" || args[0] == "down") {
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps < 1 {
+			return fmt.Errorf("invalid number of steps %q", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up(ctx, steps)
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		err = migrator.Down(ctx, steps)
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		var version uint64
+		version, err = strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		err = migrator.Goto(ctx, uint(version))
+	case "status":
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "version: %d (latest %d)\n", status.Version, status.Latest)
+	if status.Dirty {
+		fmt.Fprintln(os.Stdout, "dirty: true")
+	}
+	for _, migration := range status.Pending {
+		fmt.Fprintf(os.Stdout, "pending: %d_%s\n", migration.Version, migration.Name)
+	}
+
+	return nil
+}
+
+// Check that the database schema matches the embedded migrations before we start
+// serving requests, running against an older schema causes confusing query errors
+func checkMigrations(db *sql.DB, allowPending bool) error {
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	status, err := migrator.Status(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if status.Dirty {
+		return migrate.ErrDirty
+	}
+
+	if status.Behind() && !allowPending {
+		return fmt.Errorf("database schema is at version %d but version %d is required, run `api migrate up` or start with -db-allow-pending-migrations", status.Version, status.Latest)
+	}
+
+	return nil
+}
@@ -73,7 +73,17 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	//Let the client skip the body if its cached copy is still current
+	etag := movieETag(movie)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag, true) {
+		app.notModifiedResponse(w, etag)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -99,6 +109,15 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// If the client sent If-Match, the edit must be based on the copy it holds rather
+	// than the row we just read. Anything other than a match is a failed precondition,
+	// including a copy whose ratings have since changed.
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, movieETag(movie), false) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
 		Title   *string       `json:"title"`
@@ -141,6 +160,10 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	err = app.models.Movies.Update(movie)
 	if err != nil {
 		switch {
+		// The version check in Update() failing means the movie changed after the
+		// client's copy was taken, which for a conditional request is a 412
+		case errors.Is(data.ErrEditConflict, err) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(data.ErrEditConflict, err):
 			app.editConflictResponse(w, r)
 		default:
@@ -149,7 +172,10 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -162,11 +188,36 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	// For a conditional delete we check the client's ETag against the current movie and
+	// then only delete the row if it is still at that version
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		movie, err := app.models.Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !etagMatches(ifMatch, movieETag(movie), false) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+
+		err = app.models.Movies.DeleteVersion(id, movie.Version)
+	} else {
+		err = app.models.Movies.Delete(id)
+	}
+
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -197,10 +248,20 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
+	//Keyset pagination is opt-in, it is used whenever the cursor parameter is present
+	//(an empty cursor requests the first page)
+	input.Filters.UseCursor = qs.Has("cursor")
+	input.Filters.Cursor = qs.Get("cursor")
+	input.Filters.CursorSecret = app.config.cursor.secret
+	input.Filters.IncludeTotal = app.readBool(qs, "include_total", false, v)
+
 	//fallback to id (which will imply a ascending sort on movie ID).
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	//Add list of all supported values for sort parameters
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{
+		"id", "title", "year", "runtime", "average_rating", "rating_count",
+		"-id", "-title", "-year", "-runtime", "-average_rating", "-rating_count",
+	}
 	//Validate buisiness logic for filter parameters
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
@@ -215,8 +276,25 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	env := envelope{"metadata": metadata, "movies": movies}
+
+	//A list has no single version so its ETag is a hash of the response
+	etag, err := envelopeETag(env)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag, true) {
+		app.notModifiedResponse(w, etag)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
 	// Send a JSON response containing the movie data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "movies": movies}, nil)
+	err = app.writeJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/validator"
+)
+
+// How long a worker has to send a claimed email before another worker may claim it. It
+// needs to cover the mailer's own retries.
+const emailLease = time.Minute
+
+// Longest wait between attempts to send an email
+const emailMaxRetryDelay = 6 * time.Hour
+
+// Queue an email in the outbox, to be sent in the recipient's locale. It is sent by the
+// outbox workers, so it survives restarts and mail server outages.
+func (app *application) sendEmail(recipient, locale, template string, data map[string]any) error {
+	return app.models.EmailOutbox.Insert(recipient, locale, template, data)
+}
+
+// Start the outbox workers, they stop once the application shuts down
+func (app *application) startEmailWorkers() {
+	for i := 0; i < app.config.outbox.workers; i++ {
+		app.wg.Add(1)
+		go app.emailWorker()
+	}
+}
+
+func (app *application) emailWorker() {
+	defer app.wg.Done()
+
+	for {
+		emails, err := app.models.EmailOutbox.Claim(1, emailLease)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		for _, email := range emails {
+			app.deliverEmail(email)
+		}
+
+		//Only wait when the outbox looked empty, otherwise go straight on to the next email
+		wait := app.config.outbox.pollInterval
+		if err == nil && len(emails) > 0 {
+			wait = 0
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Send a claimed email and record the outcome. Failed emails are retried with an
+// exponential backoff until they run out of attempts, when they are marked dead.
+// Emails whose data can't be decrypted are marked dead straight away.
+func (app *application) deliverEmail(email *data.Email) {
+	//Data that can't be decrypted now never will be, most likely it was queued under a
+	//different outbox secret, so there is no point retrying
+	templateData, err := email.Data()
+	if err != nil {
+		app.logger.Warn("giving up on email", "id", email.ID, "template", email.Template, "error", err.Error())
+
+		err = app.models.EmailOutbox.MarkDead(email.ID, err.Error())
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+		return
+	}
+
+	sendErr := app.mailer.Send(email.Recipient, email.Locale, email.Template, templateData)
+
+	switch {
+	case sendErr == nil:
+		err = app.models.EmailOutbox.MarkSent(email.ID)
+	case email.Attempts >= app.config.outbox.maxAttempts:
+		app.logger.Warn("giving up on email", "id", email.ID, "template", email.Template, "attempts", email.Attempts, "error", sendErr.Error())
+		err = app.models.EmailOutbox.MarkDead(email.ID, sendErr.Error())
+	default:
+		retryAt := time.Now().Add(backoffDelay(app.config.outbox.retryBase, emailMaxRetryDelay, email.Attempts))
+		err = app.models.EmailOutbox.MarkFailed(email.ID, sendErr.Error(), retryAt)
+	}
+
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// Lists outbox emails by status, dead ones by default since those need attention
+func (app *application) listEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.EmailDead)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = "-id"
+	input.Filters.SortSafelist = []string{"-id"}
+
+	data.ValidateEmailStatus(v, input.Status)
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emails, metadata, err := app.models.EmailOutbox.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emails": emails, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Puts a dead email back in the queue, for use once whatever made it fail is fixed
+func (app *application) requeueEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	email, err := app.models.EmailOutbox.Requeue(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
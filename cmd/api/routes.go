@@ -24,12 +24,64 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission(data.MoviesWritePermission, app.deleteMovieHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission(data.MoviesReadPermission, app.listMovieHandler))
 
+	//review routes
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requirePermission(data.MoviesReadPermission, app.listReviewsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requirePermission(data.MoviesReadPermission, app.createReviewHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews/:review_id", app.requirePermission(data.MoviesReadPermission, app.showReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id/reviews/:review_id", app.requirePermission(data.MoviesReadPermission, app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/reviews/:review_id", app.requirePermission(data.MoviesReadPermission, app.deleteReviewHandler))
+
 	//user routes
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.createUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.updateUserEmailHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireNoAPIKey(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireNoAPIKey(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/export", app.requireNoAPIKey(app.createDataExportHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/export/download", app.requireNoAPIKey(app.showDataExportHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireNoAPIKey(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireNoAPIKey(app.deleteSessionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireNoAPIKey(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireNoAPIKey(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.requireNoAPIKey(app.enrollTOTPHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/confirm", app.requireActivatedUser(app.requireNoAPIKey(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.requireNoAPIKey(app.disableTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.requireNoAPIKey(app.deleteAPIKeyHandler)))
+
+	//admin routes
+	router.HandlerFunc(http.MethodGet, "/v1/permissions", app.requirePermission(data.UsersAdminPermission, app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission(data.UsersAdminPermission, app.listUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission(data.UsersAdminPermission, app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission(data.UsersAdminPermission, app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission(data.UsersAdminPermission, app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission(data.UsersAdminPermission, app.assignUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission(data.UsersAdminPermission, app.removeUserRoleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/emails", app.requirePermission(data.UsersAdminPermission, app.listEmailsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/emails/:id/requeue", app.requirePermission(data.UsersAdminPermission, app.requeueEmailHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/scheduled-tasks", app.requirePermission(data.UsersAdminPermission, app.listScheduledTasksHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/scheduled-tasks/:name/runs", app.requirePermission(data.UsersAdminPermission, app.listScheduledRunsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/lockouts", app.requirePermission(data.UsersAdminPermission, app.listLockoutsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/lockout", app.requirePermission(data.UsersAdminPermission, app.showUserLockoutHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission(data.UsersAdminPermission, app.resetUserLockoutHandler))
+
+	//role routes
+	router.HandlerFunc(http.MethodGet, "/v1/roles", app.requirePermission(data.UsersAdminPermission, app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/roles", app.requirePermission(data.UsersAdminPermission, app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/roles/:id", app.requirePermission(data.UsersAdminPermission, app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/roles/:id", app.requirePermission(data.UsersAdminPermission, app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/roles/:id", app.requirePermission(data.UsersAdminPermission, app.deleteRoleHandler))
 
 	//token routes
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireNoAPIKey(app.deleteAllAuthTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFATokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
 	//metric routes
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/cron"
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// How often an instance which isn't running the scheduled tasks tries to take over, and
+// how often the instance running them checks it still holds the lock
+const schedulerLockInterval = 30 * time.Second
+
+// A maintenance task run on a schedule by one instance at a time. run returns the number
+// of rows it affected.
+type scheduledTask struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+
+	schedule cron.Schedule
+	run      func() (int64, error)
+}
+
+// Build the scheduled tasks from their -schedule-* flags, a schedule of "off" disables a
+// task
+func (app *application) scheduledTasks() ([]*scheduledTask, error) {
+	cfg := app.config.scheduler
+
+	if cfg.unactivatedDays < 1 {
+		return nil, fmt.Errorf("-unactivated-account-days must be at least 1")
+	}
+	if cfg.historyRetention <= 0 {
+		return nil, fmt.Errorf("-history-retention must be positive")
+	}
+
+	all := []struct {
+		name string
+		spec string
+		run  func() (int64, error)
+	}{
+		{"purge_expired_tokens", cfg.purgeTokens, app.models.Tokens.DeleteExpired},
+		{"purge_expired_exports", cfg.purgeExports, app.models.DataExports.DeleteExpired},
+		{"purge_unactivated_users", cfg.purgeUnactivated, app.purgeUnactivatedUsers},
+		{"vacuum_history", cfg.vacuum, app.vacuumHistory},
+	}
+
+	var tasks []*scheduledTask
+
+	for _, t := range all {
+		if t.spec == "off" {
+			continue
+		}
+
+		schedule, err := cron.Parse(t.spec)
+		if err != nil {
+			return nil, fmt.Errorf("schedule for %s: %w", t.name, err)
+		}
+		if schedule.Next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("schedule for %s: %q never runs", t.name, t.spec)
+		}
+
+		tasks = append(tasks, &scheduledTask{Name: t.name, Schedule: t.spec, schedule: schedule, run: t.run})
+	}
+
+	return tasks, nil
+}
+
+func (app *application) purgeUnactivatedUsers() (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -app.config.scheduler.unactivatedDays)
+	return app.models.Users.DeleteUnactivated(cutoff)
+}
+
+// Delete finished emails, jobs and scheduled runs, and the record of deleted users,
+// older than -history-retention
+func (app *application) vacuumHistory() (int64, error) {
+	cutoff := time.Now().Add(-app.config.scheduler.historyRetention)
+
+	var total int64
+
+	for _, deleteBefore := range []func(time.Time) (int64, error){
+		app.models.EmailOutbox.DeleteFinishedBefore,
+		app.models.Jobs.DeleteFinishedBefore,
+		app.models.ScheduledRuns.DeleteBefore,
+		app.models.Users.DeleteDeletedBefore,
+	} {
+		n, err := deleteBefore(cutoff)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// Start the scheduler, it stops once the application shuts down. Every instance runs
+// one but only the instance holding the leader lock runs tasks.
+func (app *application) startScheduler() {
+	if len(app.tasks) == 0 {
+		return
+	}
+
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		for {
+			lock, err := app.models.ScheduledRuns.TryLeaderLock()
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+
+			if lock != nil {
+				app.logger.Info("running scheduled tasks on this instance")
+				app.leadScheduler(lock)
+
+				err = lock.Release()
+				if err != nil {
+					app.logger.Error(err.Error())
+				}
+			}
+
+			select {
+			case <-app.shutdown:
+				return
+			case <-time.After(schedulerLockInterval):
+			}
+		}
+	}()
+}
+
+// Run tasks as they come due until shutdown or the lock is lost. Each task's first run
+// follows on from its last recorded run, so a task which was due while no instance held
+// the lock runs straight away.
+func (app *application) leadScheduler(lock *data.LeaderLock) {
+	latest, err := app.models.ScheduledRuns.GetLatest()
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+
+	next := make(map[string]time.Time, len(app.tasks))
+
+	for _, task := range app.tasks {
+		if run, ok := latest[task.Name]; ok {
+			next[task.Name] = task.schedule.Next(run.StartedAt)
+		} else {
+			next[task.Name] = task.schedule.Next(time.Now())
+		}
+	}
+
+	for {
+		wait := schedulerLockInterval
+
+		for _, task := range app.tasks {
+			if time.Until(next[task.Name]) <= 0 {
+				app.runScheduledTask(task)
+				next[task.Name] = task.schedule.Next(time.Now())
+			}
+
+			wait = min(wait, time.Until(next[task.Name]))
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		case <-time.After(wait):
+		}
+
+		err := lock.Check()
+		if err != nil {
+			app.logger.Warn("lost the scheduler lock", "error", err.Error())
+			return
+		}
+	}
+}
+
+// Run a task and record the outcome in its history, a panic counts as a failure
+func (app *application) runScheduledTask(task *scheduledTask) {
+	run := &data.ScheduledRun{
+		Task:      task.Name,
+		StartedAt: time.Now(),
+	}
+
+	rows, err := func() (n int64, err error) {
+		defer func() {
+			if pv := recover(); pv != nil {
+				err = fmt.Errorf("panic: %v", pv)
+			}
+		}()
+
+		return task.run()
+	}()
+
+	run.FinishedAt = time.Now()
+	run.RowsAffected = rows
+	run.Succeeded = err == nil
+
+	if err != nil {
+		msg := err.Error()
+		run.Error = &msg
+		app.logger.Error("scheduled task failed", "task", task.Name, "error", msg)
+	} else {
+		app.logger.Info("scheduled task finished", "task", task.Name, "rows_affected", rows, "duration", run.FinishedAt.Sub(run.StartedAt).String())
+	}
+
+	err = app.models.ScheduledRuns.Insert(run)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// Lists the scheduled tasks with their most recent run
+func (app *application) listScheduledTasksHandler(w http.ResponseWriter, r *http.Request) {
+	latest, err := app.models.ScheduledRuns.GetLatest()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type taskStatus struct {
+		*scheduledTask
+		LastRun *data.ScheduledRun `json:"last_run"`
+	}
+
+	tasks := make([]taskStatus, 0, len(app.tasks))
+	for _, task := range app.tasks {
+		tasks = append(tasks, taskStatus{scheduledTask: task, LastRun: latest[task.Name]})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tasks": tasks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Lists a task's run history, most recent first
+func (app *application) listScheduledRunsHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+
+	var task *scheduledTask
+	for _, t := range app.tasks {
+		if t.Name == name {
+			task = t
+		}
+	}
+
+	if task == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = "-started_at"
+	input.Filters.SortSafelist = []string{"-started_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	runs, metadata, err := app.models.ScheduledRuns.GetAllForTask(task.Name, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"runs": runs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -41,12 +41,18 @@ func (app *application) serve() error {
 		}
 
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
+		//Tell the email and job workers to stop once they finish what they are doing,
+		//anything still queued is picked up after the next start
+		close(app.shutdown)
 		//Call Wait() to block unit wait group is zero
 		//This allows any goroutine to finish upon shutdown
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
 
+	//Maintenance tasks run on whichever instance gets the scheduler lock
+	app.startScheduler()
+
 	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
 
 	//Return the error only if it is not via Shutdown()
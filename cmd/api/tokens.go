@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// Lifetimes of the tokens sent by email, the emails tell the user how long they have
+const (
+	activationTokenTTL    = 3 * 24 * time.Hour
+	passwordResetTokenTTL = 45 * time.Minute
+	emailChangeTokenTTL   = 24 * time.Hour
+)
+
+// Generates a password reset token and emails it to the user. We respond the same way
+// whether or not the email matches an activated account so the endpoint can't be used
+// to find out which email addresses are registered.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Only activated accounts are able to reset their password
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, passwordResetTokenTTL, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.sendEmail(user.Email, user.Locale, "token_password_reset.tmpl", map[string]any{
+			"passwordResetToken": token.Plaintext,
+			"tokenTTL":           passwordResetTokenTTL,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Issues a new activation token and emails it to the user, replacing any earlier ones.
+// As with password resets the response is the same whether or not the email belongs to
+// an account awaiting activation.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Already activated accounts have nothing to do
+	if !user.Activated {
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, activationTokenTTL, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.sendEmail(user.Email, user.Locale, "token_activation.tmpl", map[string]any{
+			"activationToken": token.Plaintext,
+			"tokenTTL":        activationTokenTTL,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchanges a refresh token for a new access and refresh token pair. The presented
+// refresh token can't be used again.
+func (app *application) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.RefreshToken != "", "refresh_token", "must be provided")
+	v.Check(len(input.RefreshToken) == 26, "refresh_token", "must be 26 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tokens, err := app.models.Tokens.Rotate(input.RefreshToken, app.storedAccessTTL(), app.config.tokens.refreshTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.logger.Warn("refresh token reuse detected, token family revoked", "ip", realip.FromRequest(r))
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Signed tokens carry the activation state so the user has to be loaded
+	if app.keyring != nil {
+		user, err := app.models.Users.Get(tokens.Refresh.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.signAccessToken(tokens, user.Activated)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"token": tokens.Access, "refresh_token": tokens.Refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revokes the authentication token used to make the request, along with the refresh
+// token issued with it
+func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	//The token has already been validated by the authenticate middleware
+	token, ok := app.readBearerToken(r)
+	if !ok {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	//Signed tokens can't be deleted, so end their session and revoke them by time
+	if app.isSignedToken(token) {
+		claims, err := app.parseSignedToken(token)
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		err = app.models.Tokens.DeleteFamily(claims.userID(), claims.family())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.revokeSignedTokens(claims.userID())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		err := app.models.Tokens.DeleteForToken(data.ScopeAuthentication, token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revokes every authentication and refresh token belonging to the current user, logging
+// them out everywhere
+func (app *application) deleteAllAuthTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.revokeSignedTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/totp"
+	"github.com/frankie-mur/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// Issuer shown by authenticator apps
+const totpIssuer = "Greenlight"
+
+// Wrong codes a single MFA challenge token survives
+const mfaChallengeMaxFailures = 5
+
+// Checks a TOTP code, or failing that a recovery code, for a user with two-factor
+// authentication enabled
+func (app *application) verifySecondFactor(userID int64, totpCode, recoveryCode string) (bool, error) {
+	if totpCode != "" {
+		t, err := app.models.TOTP.Get(userID)
+		if err != nil {
+			return false, err
+		}
+
+		return app.models.TOTP.VerifyCode(t, totpCode)
+	}
+
+	if recoveryCode != "" {
+		return app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+	}
+
+	return false, nil
+}
+
+// Completes a login started without a code, exchanging the challenge token and a code
+// for a token pair
+func (app *application) createMFATokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.MFAToken != "", "mfa_token", "must be provided")
+	v.Check(len(input.MFAToken) == 26, "mfa_token", "must be 26 bytes long")
+	v.Check(input.TOTPCode != "" || input.RecoveryCode != "", "totp_code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Refuse the attempt early if this IP has too many recent failures
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleIP, realip.FromRequest(r)) {
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAChallenge, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa_token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Codes are guessable, so they count towards the account's failed logins
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleAccount, data.AccountSubject(user.ID)) {
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.TOTPCode, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		//After too many wrong codes the challenge is used up and the password has to be
+		//given again
+		err = app.models.Tokens.RecordFailure(data.ScopeMFAChallenge, input.MFAToken, mfaChallengeMaxFailures)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidSecondFactorResponse(w, r)
+		return
+	}
+
+	err = app.recordLoginSuccess(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//The challenge has been met and can't be used again
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFAChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.createSession(w, r, user)
+}
+
+// Starts enrolling the current user in two-factor authentication. The secret only takes
+// effect once a code generated from it is confirmed.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	//Load the full user, signed access tokens don't carry the email address
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	t, err := app.models.TOTP.Enroll(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.conflictResponse(w, r, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":           t.Secret,
+		"provisioning_uri": totp.ProvisioningURI(totpIssuer, user.Email, t.Secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turns on two-factor authentication once the user proves their authenticator works,
+// responding with the recovery codes
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	t, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.conflictResponse(w, r, "two-factor authentication enrollment has not been started")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Confirmed {
+		app.conflictResponse(w, r, "two-factor authentication is already enabled")
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := app.models.TOTP.VerifyCode(t, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.models.TOTP.Confirm(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turns off two-factor authentication. The user has to re-authenticate with their
+// password and a code, a stolen access token alone isn't enough.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(input.TOTPCode != "" || input.RecoveryCode != "", "totp_code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//The password and code checks below are as guessable as a login, so they share its
+	//throttling
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleIP, realip.FromRequest(r)) {
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleAccount, data.AccountSubject(user.ID)) {
+		return
+	}
+
+	enabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !enabled {
+		app.conflictResponse(w, r, "two-factor authentication is not enabled")
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.TOTPCode, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidSecondFactorResponse(w, r)
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"github.com/frankie-mur/greenlight/internal/data"
+	"github.com/frankie-mur/greenlight/internal/mailer"
 	"github.com/frankie-mur/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -14,6 +16,7 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 	//read json from request
 	err := app.readJSON(w, r, &input)
@@ -21,27 +24,47 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		app.badRequestResponse(w, r, err)
 		return
 	}
+	//Without a locale use the best match for the languages the client accepts
+	if input.Locale == "" {
+		input.Locale = mailer.NegotiateLocale(r.Header.Get("Accept-Language"))
+	}
+
 	//Create our inital User
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    input.Locale,
+	}
+
+	v := validator.New()
+	//Check the password before hashing it, the hasher refuses some passwords outright
+	if data.ValidateNewPassword(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
 	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	v := validator.New()
 	//Validate our user data
 	if data.ValidateUser(v, user); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// Insert the user, with basic read permissions, an activation token and the welcome
+	// email, in one transaction so the email is only queued if the user is created
+	err = app.models.Users.Register(user, []string{data.MoviesReadPermission}, activationTokenTTL, func(token *data.Token) (string, map[string]any) {
+		return "user_welcome.tmpl", map[string]any{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+			"tokenTTL":        activationTokenTTL,
+		}
+	})
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
@@ -56,34 +79,6 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	//Give user basic read permissions
-	err = app.models.Permissions.AddForUser(user.ID, data.MoviesReadPermission)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Generate an activation token for the user
-	token, err := app.models.Tokens.New(user.ID, (24*time.Hour)*3, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	//send a welcome email to the created user in the background
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
-	})
-
 	// Write a JSON response containing the user data
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
@@ -153,11 +148,90 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 }
 
+// Sets a new password for the user owning a valid password reset token. Once the
+// password has been changed every outstanding token for the user is revoked.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlainText string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateNewPassword(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlainText)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Get the User associated with the reset token
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//Save the new password hash, this also bumps the user version
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Revoke every token the user has, including any existing sessions
+	err = app.models.Tokens.DeleteAllScopesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//The update already revoked signed access tokens in the database, this makes it take
+	//effect on this instance without waiting for the next poll
+	err = app.revokeSignedTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 // This routes authenticates a user, and generates an auth token for that user
 func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email             string `json:"email"`
 		PlainTextPassword string `json:"password"`
+		TOTPCode          string `json:"totp_code"`
+		RecoveryCode      string `json:"recovery_code"`
 	}
 	//read request body
 	err := app.readJSON(w, r, &input)
@@ -175,11 +249,21 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	//refuse the attempt early if this IP has too many recent failures
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleIP, realip.FromRequest(r)) {
+		return
+	}
+
 	//get the user information
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.recordLoginFailure(r, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -187,24 +271,426 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	//and likewise if the account is being guessed at
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleAccount, data.AccountSubject(user.ID)) {
+		return
+	}
+
 	//validate the plain text password matches
 	match, err := user.Password.Matches(input.PlainTextPassword)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	//If not match we return autorization error response
+	//If not match we record the failure and return autorization error response
 	if !match {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	//generate the token
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+
+	//Now the plaintext is known, upgrade a hash made with an older algorithm or weaker
+	//parameters. Done in the background so it doesn't add to the login time.
+	if user.Password.NeedsRehash() {
+		//Rehash a copy, the handler carries on using the user
+		rehashed := *user
+
+		app.background(func() {
+			err := app.models.Users.Rehash(&rehashed, input.PlainTextPassword)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	//Accounts with two-factor authentication also need a code. Without one the client
+	//gets a challenge token to send along with the code to /v1/tokens/mfa
+	enabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		if input.TOTPCode == "" && input.RecoveryCode == "" {
+			challenge, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAChallenge)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": challenge}, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		ok, err := app.verifySecondFactor(user.ID, input.TOTPCode, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			err = app.recordLoginFailure(r, user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidSecondFactorResponse(w, r)
+			return
+		}
+	}
+
+	err = app.recordLoginSuccess(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.createSession(w, r, user)
+}
+
+// Issues an access and refresh token pair to a user who has fully authenticated
+func (app *application) createSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	//generate the access and refresh tokens, recording which client they were issued to
+	tokens, err := app.models.Tokens.NewSession(user.ID, app.storedAccessTTL(), app.config.tokens.refreshTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.signAccessToken(tokens, user.Activated)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	//write back the tokens as json response
+	err = app.writeJSON(w, http.StatusCreated, envelope{"token": tokens.Access, "refresh_token": tokens.Refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Returns the current user's own record
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	//Load the full user, signed access tokens only carry the id and activation state
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	etag := versionETag(int32(user.Version))
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		app.notModifiedResponse(w, etag)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-	//write back the token as json response
-	err = app.writeJSON(w, http.StatusCreated, envelope{"token": token}, nil)
+}
+
+// Partially updates the current user's profile. Send If-Match with the ETag from a
+// previous read to make sure the update doesn't overwrite a change made since. A new
+// email address is held as pending until confirmed from that address, and changing it
+// needs the current password like deleting the account does.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, versionETag(int32(user.Version)), false) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name     *string `json:"name"`
+		Email    *string `json:"email"`
+		Locale   *string `json:"locale"`
+		Password *string `json:"password"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//Only update the fields provided in the request body
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Locale != nil {
+		user.Locale = *input.Locale
+	}
+
+	changeEmail := input.Email != nil && *input.Email != user.Email
+
+	v := validator.New()
+
+	data.ValidateUser(v, user)
+	if changeEmail {
+		data.ValidateEmail(v, *input.Email)
+		v.Check(input.Password != nil && *input.Password != "", "password", "must be provided to change email")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Whoever holds a session shouldn't be able to take over the account by moving it to
+	//an address they control. Guesses are throttled like logins.
+	if changeEmail {
+		if !app.checkLoginThrottle(w, r, data.LoginThrottleIP, realip.FromRequest(r)) {
+			return
+		}
+		if !app.checkLoginThrottle(w, r, data.LoginThrottleAccount, data.AccountSubject(user.ID)) {
+			return
+		}
+
+		match, err := user.Password.Matches(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !match {
+			err = app.recordLoginFailure(r, user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	//The name and locale are saved along with a pending email, so nothing is written
+	//if the new address turns out to be taken
+	switch {
+	case changeEmail:
+		err = app.models.Users.SetPendingEmail(user, *input.Email)
+	case input.Name != nil || input.Locale != nil:
+		err = app.models.Users.Update(user)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if changeEmail {
+		err = app.sendEmailChangeToken(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(int32(user.Version)))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Replaces any outstanding email change token with a new one, sent to the pending
+// address, and lets the current address know a change was requested
+func (app *application) sendEmailChangeToken(user *data.User) error {
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(user.ID, emailChangeTokenTTL, data.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	err = app.sendEmail(*user.PendingEmail, user.Locale, "email_change_confirm.tmpl", map[string]any{
+		"emailChangeToken": token.Plaintext,
+		"tokenTTL":         emailChangeTokenTTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.sendEmail(user.Email, user.Locale, "email_change_notice.tmpl", map[string]any{
+		"newEmail": *user.PendingEmail,
+	})
+}
+
+// Confirms a pending email change using the token sent to the new address
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Users.ConfirmEmailChange(user)
+	if err != nil {
+		switch {
+		//The address was taken by someone else after the change was requested
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Deletes the current user's account along with everything belonging to it. The
+// password is required again so a stolen access token can't be used to do this.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Throttled like a login, so a stolen session can't be used to guess the password
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleIP, realip.FromRequest(r)) {
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkLoginThrottle(w, r, data.LoginThrottleAccount, data.AccountSubject(user.ID)) {
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	//Signed access tokens outlive the user row until they expire. Revoking them here
+	//takes effect at once on this instance, others pick up the deletion when they next
+	//poll for revocations.
+	err = app.revokeSignedTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
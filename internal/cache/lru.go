@@ -0,0 +1,159 @@
+// Package cache provides a size bounded, least recently used cache whose entries also
+// expire after a time to live.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// Stats holds the counters exported through expvar
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Size   int   `json:"size"`
+}
+
+// LRU is safe for concurrent use. Once it holds size entries, adding another evicts the
+// least recently used one.
+type LRU[K comparable, V any] struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[K]*list.Element
+	order *list.List
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func New[K comparable, V any](size int, ttl time.Duration) *LRU[K, V] {
+	return &LRU[K, V]{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[K]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Get returns the value for key if it is present and hasn't expired
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return zero, false
+	}
+
+	e := el.Value.(*entry[K, V])
+	if time.Now().After(e.expires) {
+		c.removeElement(el)
+		c.misses.Add(1)
+		return zero, false
+	}
+
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+
+	return e.value, true
+}
+
+// Set stores value under key using the cache's time to live
+func (c *LRU[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL stores value under key, expiring after the smaller of ttl and the cache's
+// time to live
+func (c *LRU[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	if ttl > c.ttl {
+		ttl = c.ttl
+	}
+	if ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value = value
+		e.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expires: expires})
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *LRU[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// DeleteFunc removes every entry for which fn returns true
+func (c *LRU[K, V]) DeleteFunc(fn func(key K, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+
+		e := el.Value.(*entry[K, V])
+		if fn(e.key, e.value) {
+			c.removeElement(el)
+		}
+
+		el = next
+	}
+}
+
+// Clear removes every entry
+func (c *LRU[K, V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
+}
+
+func (c *LRU[K, V]) Stats() Stats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
+
+// Must be called with the mutex held
+func (c *LRU[K, V]) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry[K, V]).key)
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[string, int](2, time.Minute)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// Using a makes b the least recently used
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing")
+	}
+
+	c.Set("c", 3)
+
+	tests := []struct {
+		key    string
+		want   int
+		wantOK bool
+	}{
+		{"a", 1, true},
+		{"b", 0, false},
+		{"c", 3, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := c.Get(tt.key)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Get(%q) = %d, %v; want %d, %v", tt.key, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestLRUSetReplaces(t *testing.T) {
+	c := New[string, int](2, time.Minute)
+
+	c.Set("a", 1)
+	c.Set("a", 2)
+
+	if got, _ := c.Get("a"); got != 2 {
+		t.Errorf("got %d; want 2", got)
+	}
+	if size := c.Stats().Size; size != 1 {
+		t.Errorf("got size %d; want 1", size)
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+	c := New[string, int](10, time.Minute)
+
+	c.SetWithTTL("short", 1, time.Millisecond)
+	c.SetWithTTL("long", 2, time.Hour)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("short"); ok {
+		t.Error("entry still present after its ttl")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Error("entry with a ttl above the cache's missing")
+	}
+	if size := c.Stats().Size; size != 1 {
+		t.Errorf("expired entry wasn't removed, got size %d; want 1", size)
+	}
+}
+
+func TestLRUNotStored(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		ttl  time.Duration
+	}{
+		{"zero size", 0, time.Minute},
+		{"zero ttl", 10, 0},
+		{"negative ttl", 10, -time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New[string, int](tt.size, time.Minute)
+			c.SetWithTTL("a", 1, tt.ttl)
+
+			if _, ok := c.Get("a"); ok {
+				t.Error("entry was stored")
+			}
+		})
+	}
+}
+
+func TestLRUDelete(t *testing.T) {
+	c := New[int, string](10, time.Minute)
+
+	for i := 1; i <= 4; i++ {
+		c.Set(i, "v")
+	}
+
+	c.Delete(1)
+	c.DeleteFunc(func(key int, _ string) bool { return key%2 == 0 })
+
+	if got := c.Stats().Size; got != 1 {
+		t.Fatalf("got size %d; want 1", got)
+	}
+	if _, ok := c.Get(3); !ok {
+		t.Error("3 missing")
+	}
+
+	c.Clear()
+
+	if _, ok := c.Get(3); ok {
+		t.Error("3 present after Clear")
+	}
+}
+
+func TestLRUStats(t *testing.T) {
+	c := New[string, int](10, time.Minute)
+
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+
+	want := Stats{Hits: 2, Misses: 1, Size: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
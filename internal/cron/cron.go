@@ -0,0 +1,204 @@
+// Package cron parses schedules written as standard five field cron expressions
+// ("minute hour day-of-month month day-of-week"), one of the @hourly style shorthands,
+// or "@every <duration>" for a fixed interval.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule gives the times a task should run at
+type Schedule interface {
+	// Next returns the first run time strictly after t, or the zero time if the
+	// schedule never runs again
+	Next(t time.Time) time.Time
+}
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a schedule. Cron expressions are evaluated in the location of the time passed
+// to Next.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("cron: invalid interval in %q: %w", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("cron: interval in %q must be at least one second", spec)
+		}
+		return every(d), nil
+	}
+
+	if expr, ok := shorthands[spec]; ok {
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: %q should have 5 fields", spec)
+	}
+
+	var s expression
+	var err error
+
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 mean Sunday
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	return s, nil
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// The allowed values of each field as a bitset
+type expression struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// Parse a comma separated list of *, n, n-m, each optionally followed by /step
+func parseField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("cron: invalid step in %q", field)
+			}
+			step = n
+		}
+
+		start, end := lo, hi
+
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			a, b, _ := strings.Cut(rangePart, "-")
+			var err1, err2 error
+			start, err1 = strconv.Atoi(a)
+			end, err2 = strconv.Atoi(b)
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("cron: invalid range in %q", field)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("cron: invalid value in %q", field)
+			}
+			start = n
+			// "n/step" means from n to the end of the range
+			if !hasStep {
+				end = n
+			}
+		}
+
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("cron: %q is outside %d-%d", field, lo, hi)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s expression) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	// As in cron, when both day fields are restricted either one matching is enough
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+func (s expression) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Every valid expression matches within a few years, this stops a day that never
+	// comes (like February 31st) looping forever
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location()))
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Move on to the wall clock time next, unless a daylight saving change means next isn't
+// later than t, in which case move on a minute. Stepping by the wall clock rather than
+// by elapsed time keeps hours aligned in zones with a half hour offset, and skips the
+// repeated hour when the clocks go back so tasks don't run twice.
+func advance(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+
+	return t.Add(time.Minute)
+}
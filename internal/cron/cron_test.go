@@ -0,0 +1,257 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+
+	return loc
+}
+
+func TestNext(t *testing.T) {
+	utc := time.UTC
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		{
+			name: "every minute",
+			spec: "* * * * *",
+			from: time.Date(2026, 3, 4, 10, 15, 30, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 10, 16, 0, 0, utc),
+				time.Date(2026, 3, 4, 10, 17, 0, 0, utc),
+			},
+		},
+		{
+			name: "hourly shorthand",
+			spec: "@hourly",
+			from: time.Date(2026, 3, 4, 10, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 11, 0, 0, 0, utc),
+				time.Date(2026, 3, 4, 12, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "list and range",
+			spec: "0 9-10,17 * * *",
+			from: time.Date(2026, 3, 4, 9, 30, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 10, 0, 0, 0, utc),
+				time.Date(2026, 3, 4, 17, 0, 0, 0, utc),
+				time.Date(2026, 3, 5, 9, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "star step",
+			spec: "*/20 * * * *",
+			from: time.Date(2026, 3, 4, 10, 41, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 11, 0, 0, 0, utc),
+				time.Date(2026, 3, 4, 11, 20, 0, 0, utc),
+			},
+		},
+		{
+			name: "n/step runs from n to the end of the range",
+			spec: "5/15 * * * *",
+			from: time.Date(2026, 3, 4, 10, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 10, 5, 0, 0, utc),
+				time.Date(2026, 3, 4, 10, 20, 0, 0, utc),
+				time.Date(2026, 3, 4, 10, 35, 0, 0, utc),
+				time.Date(2026, 3, 4, 10, 50, 0, 0, utc),
+				time.Date(2026, 3, 4, 11, 5, 0, 0, utc),
+			},
+		},
+		{
+			name: "range with step",
+			spec: "0 8-18/4 * * *",
+			from: time.Date(2026, 3, 4, 13, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 16, 0, 0, 0, utc),
+				time.Date(2026, 3, 5, 8, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "day of month only",
+			spec: "0 0 13 * *",
+			from: time.Date(2026, 3, 1, 0, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 13, 0, 0, 0, 0, utc),
+				time.Date(2026, 4, 13, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			// 2026-03-01 is a Sunday, the 13th of March a Friday
+			name: "day of month or day of week when both are restricted",
+			spec: "0 0 13 * 5",
+			from: time.Date(2026, 3, 1, 0, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 6, 0, 0, 0, 0, utc),
+				time.Date(2026, 3, 13, 0, 0, 0, 0, utc),
+				time.Date(2026, 3, 20, 0, 0, 0, 0, utc),
+				time.Date(2026, 3, 27, 0, 0, 0, 0, utc),
+				time.Date(2026, 4, 3, 0, 0, 0, 0, utc),
+				time.Date(2026, 4, 10, 0, 0, 0, 0, utc),
+				time.Date(2026, 4, 13, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "7 is Sunday",
+			spec: "0 0 * * 7",
+			from: time.Date(2026, 3, 4, 0, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 8, 0, 0, 0, 0, utc),
+				time.Date(2026, 3, 15, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "range ending at 7 includes Sunday",
+			spec: "0 0 * * 6-7",
+			from: time.Date(2026, 3, 4, 0, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 7, 0, 0, 0, 0, utc),
+				time.Date(2026, 3, 8, 0, 0, 0, 0, utc),
+				time.Date(2026, 3, 14, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "leap day",
+			spec: "0 0 29 2 *",
+			from: time.Date(2026, 3, 1, 0, 0, 0, 0, utc),
+			want: []time.Time{
+				time.Date(2028, 2, 29, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			name: "every interval",
+			spec: "@every 90m",
+			from: time.Date(2026, 3, 4, 10, 15, 30, 0, utc),
+			want: []time.Time{
+				time.Date(2026, 3, 4, 11, 45, 30, 0, utc),
+				time.Date(2026, 3, 4, 13, 15, 30, 0, utc),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkNext(t, tt.spec, tt.from, tt.want)
+		})
+	}
+}
+
+func checkNext(t *testing.T, spec string, from time.Time, want []time.Time) {
+	t.Helper()
+
+	schedule, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := from
+	for _, w := range want {
+		got = schedule.Next(got)
+		if !got.Equal(w) {
+			t.Fatalf("Next = %v; want %v", got, w)
+		}
+	}
+}
+
+func TestNextNever(t *testing.T) {
+	for _, spec := range []string{"0 0 31 2 *", "0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		schedule, err := Parse(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := schedule.Next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+			t.Errorf("%q: Next = %v; want the zero time", spec, got)
+		}
+	}
+}
+
+func TestNextDaylightSaving(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+
+	// The clocks go forward from 2:00 to 3:00 on 2026-03-08, so 2:30 never happens
+	t.Run("skipped hour", func(t *testing.T) {
+		checkNext(t, "30 2 * * *", time.Date(2026, 3, 7, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2026, 3, 9, 2, 30, 0, 0, ny),
+		})
+	})
+
+	t.Run("hourly across the skipped hour", func(t *testing.T) {
+		checkNext(t, "@hourly", time.Date(2026, 3, 8, 0, 30, 0, 0, ny), []time.Time{
+			time.Date(2026, 3, 8, 1, 0, 0, 0, ny),
+			time.Date(2026, 3, 8, 3, 0, 0, 0, ny),
+			time.Date(2026, 3, 8, 4, 0, 0, 0, ny),
+		})
+	})
+
+	t.Run("daily across the change", func(t *testing.T) {
+		checkNext(t, "@daily", time.Date(2026, 3, 7, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2026, 3, 8, 0, 0, 0, 0, ny),
+			time.Date(2026, 3, 9, 0, 0, 0, 0, ny),
+		})
+	})
+
+	// The clocks go back from 2:00 to 1:00 on 2026-11-01, so 1:30 happens twice but the
+	// task only runs the first time
+	t.Run("repeated hour", func(t *testing.T) {
+		checkNext(t, "30 1 * * *", time.Date(2026, 10, 31, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC),
+			time.Date(2026, 11, 2, 1, 30, 0, 0, ny),
+		})
+	})
+
+	t.Run("hourly across the repeated hour", func(t *testing.T) {
+		checkNext(t, "@hourly", time.Date(2026, 11, 1, 0, 30, 0, 0, ny), []time.Time{
+			time.Date(2026, 11, 1, 1, 0, 0, 0, ny),
+			time.Date(2026, 11, 1, 2, 0, 0, 0, ny),
+		})
+	})
+}
+
+func TestNextHalfHourOffset(t *testing.T) {
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+
+	checkNext(t, "0 11 * * *", time.Date(2026, 3, 4, 10, 10, 0, 0, kolkata), []time.Time{
+		time.Date(2026, 3, 4, 11, 0, 0, 0, kolkata),
+		time.Date(2026, 3, 5, 11, 0, 0, 0, kolkata),
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every 500ms",
+		"@every soon",
+		"@fortnightly",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded; want an error", spec)
+		}
+	}
+}
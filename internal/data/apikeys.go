@@ -0,0 +1,253 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Every API key starts with this prefix so leaked keys are easy to recognise and scan for
+const APIKeyPrefix = "glk_"
+
+// An API key authenticates as its owner, limited to a subset of the owner's permissions.
+// Like tokens only the hash of the key is stored, the plaintext is shown once when the
+// key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// Keys may only carry permissions their owner holds
+func ValidateAPIKey(v *validator.Validator, key *APIKey, owned Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission code")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(owned.Include(code), "permissions", fmt.Sprintf("you don't have the permission %q", code))
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Generates the key's plaintext, prefix and hash
+func generateAPIKey(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	secret := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	key.Plaintext = APIKeyPrefix + secret
+	// Enough of the key to tell keys apart in listings without revealing it
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+8]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return nil
+}
+
+// Generate and store a new key for key.UserID, filling in its plaintext
+func (m APIKeyModel) Insert(key *APIKey) error {
+	err := generateAPIKey(key)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Look up an unexpired key and its owner. The key's permissions are narrowed to those
+// the owner still holds, so revoking a permission from a user also revokes it from
+// their keys.
+func (m APIKeyModel) GetForKey(plaintext string) (*User, *APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT api_keys.id, api_keys.created_at, api_keys.name, api_keys.prefix, api_keys.expiry, api_keys.last_used_at,
+			ARRAY(
+				SELECT code FROM unnest(api_keys.permissions) AS code
+				WHERE code IN (
+					SELECT permissions.code
+					FROM permissions
+					INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+					WHERE users_permissions.user_id = users.id
+					UNION
+					SELECT permissions.code
+					FROM permissions
+					INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+					INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+					WHERE users_roles.user_id = users.id
+				)
+				ORDER BY code
+			),
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+			users.pending_email, users.locale
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > NOW())`
+
+	var (
+		user User
+		key  APIKey
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		&key.Expiry,
+		&key.LastUsedAt,
+		pq.Array(&key.Permissions),
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.Locale,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+	if key.Permissions == nil {
+		key.Permissions = Permissions{}
+	}
+
+	return &user, &key, nil
+}
+
+// Delete one of the user's keys
+func (m APIKeyModel) Delete(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Record that a key has just been used
+func (m APIKeyModel) Touch(id int64) error {
+	query := `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
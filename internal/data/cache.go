@@ -0,0 +1,190 @@
+package data
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/cache"
+)
+
+// AuthCache holds the results of the lookups done on every authenticated request:
+// authentication token to user, and user to permissions. The models invalidate entries
+// whenever they change the underlying rows. A nil *AuthCache disables caching.
+//
+// The cache is per process, so changes made through another instance are only picked
+// up once entries expire.
+//
+// Each cache has a generation that every invalidation bumps. Lookups note it before
+// reading from the database and only cache the result if it hasn't moved, otherwise a
+// change (like a logout) landing between the read and the set would be undone and the
+// stale result served until it expired.
+type AuthCache struct {
+	mu                    sync.Mutex
+	usersGeneration       uint64
+	permissionsGeneration uint64
+
+	users       *cache.LRU[string, User]
+	permissions *cache.LRU[int64, Permissions]
+}
+
+func NewAuthCache(size int, ttl time.Duration) *AuthCache {
+	return &AuthCache{
+		users:       cache.New[string, User](size, ttl),
+		permissions: cache.New[int64, Permissions](size, ttl),
+	}
+}
+
+// Stats returns the hit and miss counters for expvar
+func (c *AuthCache) Stats() map[string]cache.Stats {
+	if c == nil {
+		return nil
+	}
+
+	return map[string]cache.Stats{
+		"users":       c.users.Stats(),
+		"permissions": c.permissions.Stats(),
+	}
+}
+
+// Return a copy of the user cached for the token hash, so callers can't modify the
+// cached value
+func (c *AuthCache) getUser(tokenHash []byte) (*User, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	user, ok := c.users.Get(string(tokenHash))
+	if !ok {
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// The generation to pass to setUser, taken before the user is read from the database
+func (c *AuthCache) userGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.usersGeneration
+}
+
+// Cache the user for the token hash, unless token lookups were invalidated since the
+// generation was taken
+func (c *AuthCache) setUser(generation uint64, tokenHash []byte, user *User, expiry time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.usersGeneration {
+		return
+	}
+
+	c.users.SetWithTTL(string(tokenHash), *user, time.Until(expiry))
+}
+
+// Drop every cached token lookup for the user
+func (c *AuthCache) invalidateUser(userID int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.usersGeneration++
+
+	c.users.DeleteFunc(func(_ string, user User) bool {
+		return user.ID == userID
+	})
+}
+
+func (c *AuthCache) invalidateToken(tokenHash []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.usersGeneration++
+
+	c.users.Delete(string(tokenHash))
+}
+
+func (c *AuthCache) getPermissions(userID int64) (Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	permissions, ok := c.permissions.Get(userID)
+	if !ok {
+		return nil, false
+	}
+
+	return slices.Clone(permissions), true
+}
+
+// The generation to pass to setPermissions, taken before the permissions are read
+func (c *AuthCache) permissionGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.permissionsGeneration
+}
+
+func (c *AuthCache) setPermissions(generation uint64, userID int64, permissions Permissions) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.permissionsGeneration {
+		return
+	}
+
+	// Copied so the caller can't change the cached permissions through its own slice
+	c.permissions.Set(userID, slices.Clone(permissions))
+}
+
+func (c *AuthCache) invalidatePermissions(userID int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.permissionsGeneration++
+
+	c.permissions.Delete(userID)
+}
+
+// Drop every cached permission lookup, used when a role changes since that can affect
+// any number of users
+func (c *AuthCache) invalidateAllPermissions() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.permissionsGeneration++
+
+	c.permissions.Clear()
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A cursor marks a position in a keyset paginated listing. It records the sort that was
+// in use, the value of the sort column and the id (used as a tiebreaker) of the row on
+// the edge of the page, and which direction the next page should be read in.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+	Prev  bool   `json:"p,omitempty"`
+}
+
+// Encode the cursor into an opaque string. The JSON payload is signed with HMAC-SHA256
+// so clients can't craft their own cursors.
+func encodeCursor(secret []byte, c cursor) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Decode and verify a cursor created by encodeCursor()
+func decodeCursor(secret []byte, s string) (*cursor, error) {
+	payloadPart, sigPart, found := strings.Cut(s, ".")
+	if !found {
+		return nil, ErrInvalidCursor
+	}
+
+	enc := base64.RawURLEncoding
+
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/frankie-mur/greenlight/internal/validator"
+)
+
+var testCursorSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, c := range []cursor{
+		{Sort: "id", Value: "42", ID: 42},
+		{Sort: "-title", Value: "Moana, the \"sequel\"", ID: 7, Prev: true},
+		{Sort: "year", Value: "", ID: 1},
+	} {
+		s, err := encodeCursor(testCursorSecret, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := decodeCursor(testCursorSecret, s)
+		if err != nil {
+			t.Fatalf("decodeCursor(%q): %v", s, err)
+		}
+
+		if *got != c {
+			t.Errorf("got %+v; want %+v", *got, c)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	s, err := encodeCursor(testCursorSecret, cursor{Sort: "id", Value: "42", ID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, sig, _ := strings.Cut(s, ".")
+
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"id","v":"1","i":1}`))
+
+	tests := []struct {
+		name   string
+		cursor string
+		secret []byte
+	}{
+		{"other secret", s, []byte("another secret of at least 32 bytes")},
+		{"changed payload", forged + "." + sig, testCursorSecret},
+		{"missing signature", payload, testCursorSecret},
+		{"bad base64", payload + ".!!!", testCursorSecret},
+		{"empty", "", testCursorSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeCursor(tt.secret, tt.cursor)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestValidateFiltersCursor(t *testing.T) {
+	s, err := encodeCursor(testCursorSecret, cursor{Sort: "-year", Value: "2020", ID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sort    string
+		cursor  string
+		wantErr string
+	}{
+		{"first page", "-year", "", ""},
+		{"matching sort", "-year", s, ""},
+		{"different sort", "year", s, "does not match the sort parameter"},
+		{"invalid cursor", "-year", "garbage", "invalid cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			ValidateFilters(v, Filters{
+				Page:         1,
+				PageSize:     20,
+				Sort:         tt.sort,
+				SortSafelist: []string{"year", "-year"},
+				UseCursor:    true,
+				Cursor:       tt.cursor,
+				CursorSecret: testCursorSecret,
+			})
+
+			if got := v.Errors["cursor"]; got != tt.wantErr {
+				t.Errorf("got cursor error %q; want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// A generated archive of everything stored about a user. Only the latest export is
+// kept for each user.
+type DataExport struct {
+	UserID    int64
+	CreatedAt time.Time
+	Expiry    time.Time
+	Archive   []byte
+}
+
+type DataExportModel struct {
+	DB *sql.DB
+}
+
+// Store the export, replacing any earlier one for the user
+func (m DataExportModel) Insert(export *DataExport) error {
+	query := `
+		INSERT INTO data_exports (user_id, expiry, archive)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET created_at = NOW(), expiry = EXCLUDED.expiry, archive = EXCLUDED.archive
+		RETURNING created_at`
+
+	// Archives can be large so allow longer than usual
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, export.UserID, export.Expiry, export.Archive).Scan(&export.CreatedAt)
+}
+
+// Get the user's export if it hasn't expired
+func (m DataExportModel) GetForUser(userID int64) (*DataExport, error) {
+	query := `
+		SELECT user_id, created_at, expiry, archive
+		FROM data_exports
+		WHERE user_id = $1 AND expiry > NOW()`
+
+	var export DataExport
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&export.UserID,
+		&export.CreatedAt,
+		&export.Expiry,
+		&export.Archive,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &export, nil
+}
+
+// Get when the user's unexpired export was created, without loading the archive
+func (m DataExportModel) GetCreatedAt(userID int64) (time.Time, error) {
+	query := `
+		SELECT created_at
+		FROM data_exports
+		WHERE user_id = $1 AND expiry > NOW()`
+
+	var createdAt time.Time
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&createdAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	return createdAt, nil
+}
+
+// Delete every expired export
+func (m DataExportModel) DeleteExpired() (int64, error) {
+	query := `DELETE FROM data_exports WHERE expiry <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
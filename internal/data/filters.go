@@ -12,15 +12,25 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+
+	// When UseCursor is true keyset pagination is used instead of LIMIT/OFFSET. An empty
+	// Cursor requests the first page, CursorSecret is the key used to sign cursors and
+	// the total record count is only calculated if IncludeTotal is set.
+	UseCursor    bool
+	Cursor       string
+	CursorSecret []byte
+	IncludeTotal bool
 }
 
 // Define a new Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
@@ -32,6 +42,25 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	// A cursor is only valid for the sort it was created with.
+	if f.UseCursor && f.Cursor != "" {
+		c, err := f.decodeCursor()
+		if err != nil {
+			v.AddError("cursor", "invalid cursor")
+			return
+		}
+		v.Check(c.Sort == f.Sort, "cursor", "does not match the sort parameter")
+	}
+}
+
+// Decode the client-provided cursor, returns nil if no cursor was provided
+func (f Filters) decodeCursor() (*cursor, error) {
+	if f.Cursor == "" {
+		return nil, nil
+	}
+
+	return decodeCursor(f.CursorSecret, f.Cursor)
 }
 
 func (f Filters) limit() int {
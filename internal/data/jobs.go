@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Job states. Pending jobs are retried until they succeed or run out of attempts, when
+// they are dead.
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	JobDead    = "dead"
+)
+
+// A unit of background work, run by the job handler registered for its kind. Jobs with
+// a higher priority run first, then those which have been due the longest.
+type Job struct {
+	ID          int64
+	CreatedAt   time.Time
+	Kind        string
+	Payload     json.RawMessage
+	Priority    int
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	Backoff     time.Duration
+	RunAt       time.Time
+	LastError   *string
+	FinishedAt  *time.Time
+}
+
+type JobModel struct {
+	DB *sql.DB
+}
+
+// Queue a job. A zero RunAt runs it as soon as possible.
+func (m JobModel) Insert(job *Job) error {
+	query := `
+		INSERT INTO jobs (kind, payload, priority, max_attempts, backoff_seconds, run_at)
+		VALUES ($1, $2, $3, $4, $5, COALESCE($6, NOW()))
+		RETURNING id, created_at, status, run_at`
+
+	var runAt *time.Time
+	if !job.RunAt.IsZero() {
+		runAt = &job.RunAt
+	}
+
+	args := []any{job.Kind, []byte(job.Payload), job.Priority, job.MaxAttempts, int(job.Backoff.Seconds()), runAt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&job.ID, &job.CreatedAt, &job.Status, &job.RunAt)
+}
+
+// Reports whether a job of the kind, with a payload containing the given JSON, is still
+// waiting to run or be retried
+func (m JobModel) ExistsPending(kind string, payload json.RawMessage) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM jobs
+			WHERE kind = $1 AND status = 'pending' AND payload @> $2
+		)`
+
+	var exists bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, kind, []byte(payload)).Scan(&exists)
+	return exists, err
+}
+
+// Claim the next due job, or return nil if there isn't one. As with emails the claim
+// counts as an attempt and holds the job for lease, after which a job whose worker died
+// is run again.
+func (m JobModel) Claim(lease time.Duration) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET attempts = attempts + 1, run_at = NOW() + make_interval(secs => $1)
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = 'pending' AND run_at <= NOW()
+			ORDER BY priority DESC, run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, kind, payload, priority, status, attempts, max_attempts, backoff_seconds, run_at, last_error, finished_at`
+
+	var job Job
+	var backoff int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Seconds()).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&job.Payload,
+		&job.Priority,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&backoff,
+		&job.RunAt,
+		&job.LastError,
+		&job.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	job.Backoff = time.Duration(backoff) * time.Second
+
+	return &job, nil
+}
+
+func (m JobModel) MarkDone(id int64) error {
+	query := `
+		UPDATE jobs
+		SET status = 'done', finished_at = NOW(), last_error = NULL
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Record a failed attempt, the job runs again at retryAt
+func (m JobModel) MarkFailed(id int64, jobErr string, retryAt time.Time) error {
+	query := `
+		UPDATE jobs
+		SET last_error = $1, run_at = $2
+		WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jobErr, retryAt, id)
+	return err
+}
+
+// Record a failed attempt after which the job won't be run again
+func (m JobModel) MarkDead(id int64, jobErr string) error {
+	query := `
+		UPDATE jobs
+		SET status = 'dead', last_error = $1, finished_at = NOW()
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jobErr, id)
+	return err
+}
+
+// Delete done and dead jobs which finished before the given time
+func (m JobModel) DeleteFinishedBefore(t time.Time) (int64, error) {
+	query := `
+		DELETE FROM jobs
+		WHERE status IN ('done', 'dead') AND finished_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Counts of jobs by status, with pending jobs split into those due now and those waiting
+// for a retry or their run time
+type JobCounts struct {
+	Due     int `json:"due"`
+	Waiting int `json:"waiting"`
+	Dead    int `json:"dead"`
+}
+
+func (m JobModel) Counts() (JobCounts, error) {
+	query := `
+		SELECT
+			count(*) FILTER (WHERE status = 'pending' AND run_at <= NOW()),
+			count(*) FILTER (WHERE status = 'pending' AND run_at > NOW()),
+			count(*) FILTER (WHERE status = 'dead')
+		FROM jobs
+		WHERE status IN ('pending', 'dead')`
+
+	var counts JobCounts
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&counts.Due, &counts.Waiting, &counts.Dead)
+
+	return counts, err
+}
@@ -0,0 +1,205 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// What failed login attempts are counted against
+const (
+	LoginThrottleAccount = "account"
+	LoginThrottleIP      = "ip"
+)
+
+// Once FreeAttempts failures have been made further attempts are refused for a delay
+// starting at BaseDelay and doubling with each failure up to MaxDelay, at which point the
+// subject counts as locked out. Failures older than Window are forgotten.
+type LockoutPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+func (p LockoutPolicy) Delay(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+
+	return min(delay, p.MaxDelay)
+}
+
+// LockedOut reports whether this failure is the one that reached the maximum delay
+func (p LockoutPolicy) LockedOut(failures int) bool {
+	return p.Delay(failures) == p.MaxDelay && p.Delay(failures-1) < p.MaxDelay
+}
+
+// Failed login attempts recorded for an account (by user id) or an IP address
+type LoginThrottle struct {
+	Kind         string     `json:"kind"`
+	Subject      string     `json:"subject"`
+	Failures     int        `json:"failures"`
+	LastFailedAt time.Time  `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until"`
+}
+
+// Locked reports whether attempts are currently being refused
+func (t *LoginThrottle) Locked() bool {
+	return t.LockedUntil != nil && t.LockedUntil.After(time.Now())
+}
+
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// Subject used for account throttles
+func AccountSubject(userID int64) string {
+	return strconv.FormatInt(userID, 10)
+}
+
+// Get the throttle for a subject, a subject without recent failures has an empty one
+func (m LoginThrottleModel) Get(kind, subject string) (*LoginThrottle, error) {
+	query := `
+		SELECT kind, subject, failures, last_failed_at, locked_until
+		FROM login_throttles
+		WHERE kind = $1 AND subject = $2`
+
+	var t LoginThrottle
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, kind, subject).Scan(
+		&t.Kind,
+		&t.Subject,
+		&t.Failures,
+		&t.LastFailedAt,
+		&t.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &LoginThrottle{Kind: kind, Subject: subject}, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Record a failed attempt and apply the policy's delay
+func (m LoginThrottleModel) RecordFailure(kind, subject string, policy LockoutPolicy) (*LoginThrottle, error) {
+	query := `
+		INSERT INTO login_throttles (kind, subject, failures, last_failed_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (kind, subject) DO UPDATE
+		SET failures = CASE
+				WHEN login_throttles.last_failed_at < NOW() - make_interval(secs => $3) THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failed_at = NOW()
+		RETURNING kind, subject, failures, last_failed_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var t LoginThrottle
+
+	err = tx.QueryRowContext(ctx, query, kind, subject, policy.Window.Seconds()).Scan(
+		&t.Kind,
+		&t.Subject,
+		&t.Failures,
+		&t.LastFailedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if delay := policy.Delay(t.Failures); delay > 0 {
+		lockedUntil := time.Now().Add(delay)
+		t.LockedUntil = &lockedUntil
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE login_throttles SET locked_until = $3 WHERE kind = $1 AND subject = $2`, kind, subject, t.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Clear the failures for a subject, after a successful login or by an admin
+func (m LoginThrottleModel) Reset(kind, subject string) error {
+	query := `DELETE FROM login_throttles WHERE kind = $1 AND subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, kind, subject)
+	return err
+}
+
+// Return every throttle that is currently refusing attempts, longest locked first
+func (m LoginThrottleModel) GetAllLocked() ([]*LoginThrottle, error) {
+	query := `
+		SELECT kind, subject, failures, last_failed_at, locked_until
+		FROM login_throttles
+		WHERE locked_until > NOW()
+		ORDER BY locked_until DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	throttles := []*LoginThrottle{}
+
+	for rows.Next() {
+		var t LoginThrottle
+
+		err := rows.Scan(
+			&t.Kind,
+			&t.Subject,
+			&t.Failures,
+			&t.LastFailedAt,
+			&t.LockedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		throttles = append(throttles, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+var testLockoutPolicy = LockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     10 * time.Second,
+	Window:       time.Hour,
+}
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := testLockoutPolicy.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d) = %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutPolicyDelayBaseAboveMax(t *testing.T) {
+	p := LockoutPolicy{FreeAttempts: 0, BaseDelay: time.Minute, MaxDelay: 10 * time.Second}
+
+	if got := p.Delay(1); got != 10*time.Second {
+		t.Errorf("Delay(1) = %v; want %v", got, 10*time.Second)
+	}
+}
+
+// Only the failure that first reaches the maximum delay locks the account, so the
+// lockout email is sent once
+func TestLockoutPolicyLockedOut(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     bool
+	}{
+		{3, false},
+		{7, false},
+		{8, true},
+		{9, false},
+		{50, false},
+	}
+
+	for _, tt := range tests {
+		if got := testLockoutPolicy.LockedOut(tt.failures); got != tt.want {
+			t.Errorf("LockedOut(%d) = %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+}
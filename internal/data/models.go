@@ -11,17 +11,37 @@ var (
 )
 
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies         MovieModel
+	Users          UserModel
+	Tokens         TokenModel
+	Permissions    PermissionModel
+	Reviews        ReviewModel
+	Roles          RoleModel
+	APIKeys        APIKeyModel
+	TOTP           TOTPModel
+	LoginThrottles LoginThrottleModel
+	DataExports    DataExportModel
+	EmailOutbox    EmailOutboxModel
+	Jobs           JobModel
+	ScheduledRuns  ScheduledRunModel
 }
 
-func NewModels(db *sql.DB) Models {
+// Create the models, authCache is shared by the models that read or invalidate cached
+// authentication lookups and may be nil to disable caching
+func NewModels(db *sql.DB, authCache *AuthCache) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:         MovieModel{DB: db},
+		Users:          UserModel{DB: db, Cache: authCache},
+		Tokens:         TokenModel{DB: db, Cache: authCache},
+		Permissions:    PermissionModel{DB: db, Cache: authCache},
+		Reviews:        ReviewModel{DB: db},
+		Roles:          RoleModel{DB: db, Cache: authCache},
+		APIKeys:        APIKeyModel{DB: db},
+		TOTP:           TOTPModel{DB: db},
+		LoginThrottles: LoginThrottleModel{DB: db},
+		DataExports:    DataExportModel{DB: db},
+		EmailOutbox:    EmailOutboxModel{DB: db},
+		Jobs:           JobModel{DB: db},
+		ScheduledRuns:  ScheduledRunModel{DB: db},
 	}
 }
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/frankie-mur/greenlight/internal/validator"
@@ -12,15 +14,26 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID            int64     `json:"id"`
+	CreatedAt     time.Time `json:"-"`
+	Title         string    `json:"title"`
+	Year          int32     `json:"year,omitempty"`
+	Runtime       Runtime   `json:"runtime,omitempty"`
+	Genres        []string  `json:"genres,omitempty"`
+	Version       int32     `json:"version"`
+	AverageRating float64   `json:"average_rating"`
+	RatingCount   int64     `json:"rating_count"`
 }
 
+// Lateral join used to aggregate the reviews of each movie, an aggregate without a
+// GROUP BY always returns a single row so movies without reviews get zero values.
+const movieRatingsJoin = `
+		LEFT JOIN LATERAL (
+			SELECT COALESCE(avg(reviews.rating), 0)::float8 AS average_rating, count(*) AS rating_count
+			FROM reviews
+			WHERE reviews.movie_id = movies.id
+		) ratings ON true`
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
@@ -75,9 +88,10 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	var movie Movie
 
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
-		FROM movies
-		WHERE id = $1`
+		SELECT movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres, movies.version,
+			ratings.average_rating, ratings.rating_count
+		FROM movies` + movieRatingsJoin + `
+		WHERE movies.id = $1`
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -91,6 +105,8 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.AverageRating,
+		&movie.RatingCount,
 	)
 
 	if err != nil {
@@ -173,10 +189,44 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
+// Delete the movie only if it is still at the given version, a mismatch (or the movie
+// having been deleted already) is reported as ErrEditConflict.
+func (m MovieModel) DeleteVersion(id int64, version int32) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM movies WHERE id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, id, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	if filters.UseCursor {
+		return m.getAllByCursor(title, genres, filters)
+	}
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-		FROM movies
+		SELECT count(*) OVER(), movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.version, ratings.average_rating, ratings.rating_count
+		FROM movies`+movieRatingsJoin+`
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
 		AND (genres @> $2 OR $2 = '{}')     
 		ORDER BY %s %s, id ASC
@@ -210,6 +260,8 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.AverageRating,
+			&movie.RatingCount,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -224,3 +276,175 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	return movies, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
 }
+
+// Map each sortable column to the expression used to compare against it in a keyset
+// WHERE clause, output column names can only be used in ORDER BY.
+var movieSortExpressions = map[string]string{
+	"id":             "movies.id",
+	"title":          "movies.title",
+	"year":           "movies.year",
+	"runtime":        "movies.runtime",
+	"average_rating": "ratings.average_rating",
+	"rating_count":   "ratings.rating_count",
+}
+
+// Return the value of the given sort column for the movie, formatted so that
+// PostgreSQL can parse it back into the column type.
+func (movie *Movie) sortValue(column string) string {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return strconv.FormatInt(int64(movie.Year), 10)
+	case "runtime":
+		return strconv.FormatInt(int64(movie.Runtime), 10)
+	case "average_rating":
+		return strconv.FormatFloat(movie.AverageRating, 'g', -1, 64)
+	case "rating_count":
+		return strconv.FormatInt(movie.RatingCount, 10)
+	default:
+		return strconv.FormatInt(movie.ID, 10)
+	}
+}
+
+// Keyset paginated version of GetAll(). Rather than skipping rows with OFFSET we
+// continue from the position recorded in the cursor, so deep pages stay fast and rows
+// inserted while a client is paging don't cause duplicates or skips.
+func (m MovieModel) getAllByCursor(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	c, err := filters.decodeCursor()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	column := filters.sortColumn()
+	expr := movieSortExpressions[column]
+	direction := filters.sortDirection()
+
+	// Comparison operators and ordering for reading forwards, the id tiebreaker is
+	// always ascending to match the ORDER BY used by GetAll().
+	valueOp, idOp, idDirection := ">", ">", "ASC"
+	if direction == "DESC" {
+		valueOp = "<"
+	}
+
+	// When reading backwards everything is flipped and the rows are reversed afterwards.
+	backwards := c != nil && c.Prev
+	if backwards {
+		valueOp, idOp, idDirection = flipOp(valueOp), "<", "DESC"
+		if direction == "ASC" {
+			direction = "DESC"
+		} else {
+			direction = "ASC"
+		}
+	}
+
+	args := []any{title, pq.Array(genres), filters.limit() + 1}
+
+	keyset := "true"
+	if c != nil {
+		keyset = fmt.Sprintf("(%[1]s %[2]s $4 OR (%[1]s = $4 AND movies.id %[3]s $5))", expr, valueOp, idOp)
+		args = append(args, c.Value, c.ID)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.version, ratings.average_rating, ratings.rating_count
+		FROM movies`+movieRatingsJoin+`
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (genres @> $2 OR $2 = '{}')
+		AND %s
+		ORDER BY %s %s, movies.id %s
+		LIMIT $3`, keyset, expr, direction, idDirection)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.AverageRating,
+			&movie.RatingCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// We asked for one extra row to find out if there is anything beyond this page.
+	hasMore := len(movies) > filters.limit()
+	if hasMore {
+		movies = movies[:filters.limit()]
+	}
+
+	if backwards {
+		slices.Reverse(movies)
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+
+	if len(movies) > 0 {
+		first, last := movies[0], movies[len(movies)-1]
+
+		// Going forwards there is a next page if we found the extra row, and a previous
+		// page if we started from a cursor. Going backwards it is the other way round.
+		if hasMore || backwards {
+			metadata.NextCursor, err = encodeCursor(filters.CursorSecret, cursor{Sort: filters.Sort, Value: last.sortValue(column), ID: last.ID})
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+		if (backwards && hasMore) || (!backwards && c != nil) {
+			metadata.PrevCursor, err = encodeCursor(filters.CursorSecret, cursor{Sort: filters.Sort, Value: first.sortValue(column), ID: first.ID, Prev: true})
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+	}
+
+	// Counting every matching row is expensive so it is opt-in.
+	if filters.IncludeTotal {
+		query := `
+			SELECT count(*)
+			FROM movies
+			WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+			AND (genres @> $2 OR $2 = '{}')`
+
+		err = m.DB.QueryRowContext(ctx, query, title, pq.Array(genres)).Scan(&metadata.TotalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	return movies, metadata, nil
+}
+
+func flipOp(op string) string {
+	if op == ">" {
+		return "<"
+	}
+
+	return ">"
+}
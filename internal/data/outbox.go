@@ -0,0 +1,356 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/validator"
+)
+
+// The states an outbox email moves through. Pending emails are retried until they are
+// sent or run out of attempts, after which they are dead until requeued.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+// The AES-256 key the template data of queued emails is encrypted with, set from the
+// command line flags at startup. The data often holds tokens, which must not sit in the
+// database in plaintext when only their hashes are stored in the tokens table.
+var EmailDataKey []byte
+
+var ErrEmailDataMissing = errors.New("email template data is missing")
+
+// An email waiting to be sent, or the record of one that was. The template data is
+// only kept, encrypted, until the email is sent.
+type Email struct {
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Recipient     string     `json:"recipient"`
+	Locale        string     `json:"locale"`
+	Template      string     `json:"template"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     *string    `json:"last_error,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+
+	sealedData []byte
+}
+
+// Decrypt the template data of a claimed email
+func (e *Email) Data() (map[string]any, error) {
+	if len(e.sealedData) == 0 {
+		return nil, ErrEmailDataMissing
+	}
+
+	js, err := openEmailData(e.sealedData)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]any
+
+	// Keep numbers as they were rather than turning them into floats
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	err = dec.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Encrypt with AES-GCM, the random nonce is prepended to the ciphertext
+func sealEmailData(js []byte) ([]byte, error) {
+	gcm, err := emailDataCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(js)+gcm.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, js, nil), nil
+}
+
+func openEmailData(sealed []byte) ([]byte, error) {
+	gcm, err := emailDataCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("email template data is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func emailDataCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(EmailDataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type EmailOutboxModel struct {
+	DB *sql.DB
+}
+
+// Queue an email to be sent by the outbox workers
+func (m EmailOutboxModel) Insert(recipient, locale, template string, data map[string]any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertEmail(ctx, m.DB, recipient, locale, template, data)
+}
+
+// Queue an email as part of a larger transaction, so it is only sent if the changes it
+// tells the user about are committed
+func insertEmail(ctx context.Context, db execer, recipient, locale, template string, data map[string]any) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sealEmailData(js)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO email_outbox (recipient, locale, template, data)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err = db.ExecContext(ctx, query, recipient, locale, template, sealed)
+	return err
+}
+
+// Claim up to limit emails that are due. Claiming counts as an attempt and pushes the
+// next attempt back by lease, so if the worker dies before recording the outcome the
+// email is picked up again once the lease runs out. SKIP LOCKED lets several workers,
+// in this or other instances, claim at the same time without waiting on each other.
+func (m EmailOutboxModel) Claim(limit int, lease time.Duration) ([]*Email, error) {
+	query := `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $1)
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, recipient, locale, template, data, status, attempts, next_attempt_at, last_error, sent_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+
+		err := rows.Scan(
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Locale,
+			&email.Template,
+			&email.sealedData,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.SentAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// Record that the email was sent. Its template data is no longer needed so it is
+// dropped, along with any tokens in it.
+func (m EmailOutboxModel) MarkSent(id int64) error {
+	query := `
+		UPDATE email_outbox
+		SET status = 'sent', sent_at = NOW(), last_error = NULL, data = NULL
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Record a failed attempt, the email is tried again at retryAt
+func (m EmailOutboxModel) MarkFailed(id int64, sendErr string, retryAt time.Time) error {
+	query := `
+		UPDATE email_outbox
+		SET last_error = $1, next_attempt_at = $2
+		WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sendErr, retryAt, id)
+	return err
+}
+
+// Record a failed attempt after which the email won't be retried. The encrypted
+// template data is kept so the email can still be requeued.
+func (m EmailOutboxModel) MarkDead(id int64, sendErr string) error {
+	query := `
+		UPDATE email_outbox
+		SET status = 'dead', last_error = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sendErr, id)
+	return err
+}
+
+// Delete sent and dead emails older than the given time
+func (m EmailOutboxModel) DeleteFinishedBefore(t time.Time) (int64, error) {
+	query := `
+		DELETE FROM email_outbox
+		WHERE status IN ('sent', 'dead') AND created_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func ValidateEmailStatus(v *validator.Validator, status string) {
+	v.Check(validator.PermittedValue(status, EmailPending, EmailSent, EmailDead), "status", "must be pending, sent or dead")
+}
+
+// List emails with the given status, newest first
+func (m EmailOutboxModel) GetAll(status string, filters Filters) ([]*Email, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, created_at, recipient, locale, template, status, attempts, next_attempt_at, last_error, sent_at
+		FROM email_outbox
+		WHERE status = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Locale,
+			&email.Template,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return emails, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Put a dead email back in the queue with a fresh set of attempts
+func (m EmailOutboxModel) Requeue(id int64) (*Email, error) {
+	query := `
+		UPDATE email_outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'dead'
+		RETURNING id, created_at, recipient, locale, template, status, attempts, next_attempt_at, last_error, sent_at`
+
+	var email Email
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Recipient,
+		&email.Locale,
+		&email.Template,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+		&email.SentAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &email, nil
+}
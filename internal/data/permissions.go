@@ -3,8 +3,11 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/frankie-mur/greenlight/internal/validator"
 	"github.com/lib/pq"
 )
 
@@ -13,10 +16,16 @@ type Permissions []string
 var (
 	MoviesReadPermission  = "movies:read"
 	MoviesWritePermission = "movies:write"
+	UsersAdminPermission  = "users:admin"
+)
+
+var (
+	ErrUnknownPermission = errors.New("unknown permission code")
 )
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 func (p Permissions) Include(code string) bool {
@@ -28,14 +37,27 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
-// Return all permissions for a given user
+// Return all permissions for a given user, both those granted directly and those
+// granted through the user's roles
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
+		ORDER BY code`
+
+	if permissions, ok := m.Cache.getPermissions(userID); ok {
+		return permissions, nil
+	}
+
+	generation := m.Cache.permissionGeneration()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -44,8 +66,9 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var permissions Permissions
+	permissions := Permissions{}
 
 	for rows.Next() {
 		var permission string
@@ -61,18 +84,134 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
+	m.Cache.setPermissions(generation, userID, permissions)
+
 	return permissions, nil
 }
 
-// Given a userID add provided permission codes to table
+// Return every permission code in the permissions table
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Given a userID add provided permission codes to table. Codes the user already has are
+// skipped, and if any of the codes don't exist nothing is granted and
+// ErrUnknownPermission is returned.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
 
 	ctx, canel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer canel()
 
+	unknown, err := m.unknownCodes(ctx, codes)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownPermission, unknown[0])
+	}
+
+	_, err = m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidatePermissions(userID)
+
+	return nil
+}
+
+// Given a userID remove the provided permission codes from the user
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidatePermissions(userID)
+
+	return nil
+}
+
+// Return the codes that don't exist in the permissions table
+func (m PermissionModel) unknownCodes(ctx context.Context, codes []string) ([]string, error) {
+	query := `
+		SELECT DISTINCT requested.code
+		FROM unnest($1::text[]) AS requested(code)
+		WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = requested.code)`
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(codes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unknown []string
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		unknown = append(unknown, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return unknown, nil
+}
+
+// Check a list of permission codes provided by a client against the known codes, any
+// errors are recorded under key
+func ValidatePermissionCodes(v *validator.Validator, key string, codes []string, known Permissions) {
+	v.Check(len(codes) > 0, key, "must contain at least 1 permission code")
+	v.Check(validator.Unique(codes), key, "must not contain duplicate values")
+
+	for _, code := range codes {
+		v.Check(known.Include(code), key, fmt.Sprintf("unknown permission code %q", code))
+	}
 }
@@ -0,0 +1,382 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+	ErrUnknownRole       = errors.New("unknown role")
+)
+
+// A role bundles a set of permission codes that can be assigned to users together
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	Version     int32       `json:"version"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role, known Permissions) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+
+	ValidatePermissionCodes(v, "permissions", role.Permissions, known)
+}
+
+type RoleModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// Select used by every read, aggregating the permission codes of each role
+const roleSelect = `
+		SELECT roles.id, roles.created_at, roles.name, roles.description, roles.version,
+			array_remove(array_agg(permissions.code ORDER BY permissions.code), NULL)
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id`
+
+func scanRole(row interface{ Scan(...any) error }) (*Role, error) {
+	var role Role
+
+	err := row.Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		&role.Version,
+		pq.Array(&role.Permissions),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if role.Permissions == nil {
+		role.Permissions = Permissions{}
+	}
+
+	return &role, nil
+}
+
+// Insert a role along with its permissions
+func (m RoleModel) Insert(role *Role) error {
+	query := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := roleSelect + `
+		WHERE roles.id = $1
+		GROUP BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := roleSelect + `
+		GROUP BY roles.id
+		ORDER BY roles.id`
+
+	return m.query(query)
+}
+
+// Return the roles assigned to a user
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	query := roleSelect + `
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		GROUP BY roles.id
+		ORDER BY roles.id`
+
+	return m.query(query, userID)
+}
+
+func (m RoleModel) query(query string, args ...any) ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Update the role and replace its permissions, checking the version to prevent
+// concurrent edits overwriting each other. The signed access tokens of everyone holding
+// the role are revoked as of validAfter, since they carry the old permissions, and the
+// holders' ids are returned.
+func (m RoleModel) Update(role *Role, validAfter time.Time) ([]int64, error) {
+	query := `
+		UPDATE roles
+		SET name = $1, description = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	args := []any{role.Name, role.Description, role.ID, role.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return nil, ErrDuplicateRoleName
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, role.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return nil, err
+	}
+
+	holders, err := revokeRoleHolders(ctx, tx, role.ID, validAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	// Any number of users could hold this role
+	m.Cache.invalidateAllPermissions()
+
+	return holders, nil
+}
+
+// Delete the role, revoking the signed access tokens of everyone who held it as of
+// validAfter. Returns the ids of the former holders.
+func (m RoleModel) Delete(id int64, validAfter time.Time) ([]int64, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Before the delete, which takes the role's assignments with it
+	holders, err := revokeRoleHolders(ctx, tx, id, validAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM roles WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Cache.invalidateAllPermissions()
+
+	return holders, nil
+}
+
+// Revoke the signed access tokens of every user holding the role, returning their ids
+func revokeRoleHolders(ctx context.Context, tx *sql.Tx, roleID int64, validAfter time.Time) ([]int64, error) {
+	query := `
+		UPDATE users
+		SET tokens_valid_after = $1
+		FROM users_roles
+		WHERE users_roles.user_id = users.id AND users_roles.role_id = $2
+		RETURNING users.id`
+
+	rows, err := tx.QueryContext(ctx, query, validAfter, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holders []int64
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		holders = append(holders, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return holders, nil
+}
+
+// Assign the named roles to a user, roles the user already has are skipped. If any of
+// the names don't exist nothing is assigned and ErrUnknownRole is returned.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var unknown sql.NullString
+
+	err := m.DB.QueryRowContext(ctx, `
+		SELECT min(requested.name)
+		FROM unnest($1::text[]) AS requested(name)
+		WHERE NOT EXISTS (SELECT 1 FROM roles WHERE roles.name = requested.name)`, pq.Array(names)).Scan(&unknown)
+	if err != nil {
+		return err
+	}
+	if unknown.Valid {
+		return fmt.Errorf("%w: %s", ErrUnknownRole, unknown.String)
+	}
+
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err = m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidatePermissions(userID)
+
+	return nil
+}
+
+// Remove the named roles from a user
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidatePermissions(userID)
+
+	return nil
+}
+
+func setRolePermissions(ctx context.Context, tx *sql.Tx, role *Role) error {
+	query := `
+		INSERT INTO roles_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err := tx.ExecContext(ctx, query, role.ID, pq.Array(role.Permissions))
+	return err
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The advisory lock held by the instance running scheduled tasks
+const schedulerLockKey = 0x676c5f7363686564
+
+// A record of one run of a scheduled task
+type ScheduledRun struct {
+	ID           int64     `json:"id"`
+	Task         string    `json:"task"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	Succeeded    bool      `json:"succeeded"`
+	RowsAffected int64     `json:"rows_affected"`
+	Error        *string   `json:"error,omitempty"`
+}
+
+type ScheduledRunModel struct {
+	DB *sql.DB
+}
+
+// LeaderLock is held while this instance runs the scheduled tasks. It is a session level
+// advisory lock, so it is released if the connection or the process dies.
+type LeaderLock struct {
+	conn *sql.Conn
+}
+
+// Try to become the instance that runs scheduled tasks. Returns nil if another instance
+// already holds the lock.
+func (m ScheduledRunModel) TryLeaderLock() (*LeaderLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// The lock belongs to a session, so hold on to a connection of our own rather than
+	// returning it to the pool
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, int64(schedulerLockKey)).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, err
+	}
+
+	return &LeaderLock{conn: conn}, nil
+}
+
+// Check the lock is still held, which it is as long as its connection is alive
+func (l *LeaderLock) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return l.conn.PingContext(ctx)
+}
+
+func (l *LeaderLock) Release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := l.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, int64(schedulerLockKey))
+
+	// Closing the connection releases the lock anyway if the unlock failed
+	closeErr := l.conn.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+func (m ScheduledRunModel) Insert(run *ScheduledRun) error {
+	query := `
+		INSERT INTO scheduled_runs (task, started_at, finished_at, succeeded, rows_affected, error)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	args := []any{run.Task, run.StartedAt, run.FinishedAt, run.Succeeded, run.RowsAffected, run.Error}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&run.ID)
+}
+
+// Get the most recent run of each task, keyed by task name
+func (m ScheduledRunModel) GetLatest() (map[string]*ScheduledRun, error) {
+	query := `
+		SELECT DISTINCT ON (task) id, task, started_at, finished_at, succeeded, rows_affected, error
+		FROM scheduled_runs
+		ORDER BY task, started_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latest := make(map[string]*ScheduledRun)
+
+	for rows.Next() {
+		var run ScheduledRun
+
+		err := rows.Scan(
+			&run.ID,
+			&run.Task,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Succeeded,
+			&run.RowsAffected,
+			&run.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		latest[run.Task] = &run
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return latest, nil
+}
+
+// Get a task's runs, most recent first
+func (m ScheduledRunModel) GetAllForTask(task string, filters Filters) ([]*ScheduledRun, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, task, started_at, finished_at, succeeded, rows_affected, error
+		FROM scheduled_runs
+		WHERE task = $1
+		ORDER BY started_at DESC, id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, task, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	runs := []*ScheduledRun{}
+
+	for rows.Next() {
+		var run ScheduledRun
+
+		err := rows.Scan(
+			&totalRecords,
+			&run.ID,
+			&run.Task,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Succeeded,
+			&run.RowsAffected,
+			&run.Error,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		runs = append(runs, &run)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return runs, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Delete runs which started before the given time
+func (m ScheduledRunModel) DeleteBefore(t time.Time) (int64, error) {
+	query := `DELETE FROM scheduled_runs WHERE started_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
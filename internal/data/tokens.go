@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/frankie-mur/greenlight/internal/validator"
@@ -15,10 +16,20 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeMFAChallenge   = "mfa-challenge"
+	ScopeEmailChange    = "email-change"
+	ScopeDataExport     = "data-export"
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("refresh token reused")
 )
 
 type TokenModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 type Token struct {
@@ -27,6 +38,34 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	ClientIP  string    `json:"-"`
+	Family    []byte    `json:"-"`
+}
+
+// The access and refresh tokens issued by a login or a refresh. Every pair descending
+// from the same login shares a family, so the whole chain can be revoked at once.
+type TokenPair struct {
+	Access  *Token
+	Refresh *Token
+}
+
+// Anything tokens can be inserted through, a *sql.DB or a *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// A session is a login as shown back to its owner: either a token family or a lone
+// authentication token. It is identified by a token id so hashes never leave the
+// database.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	ClientIP   string     `json:"client_ip"`
+	Current    bool       `json:"current"`
 }
 
 // Method wraps token generation and insertion into database
@@ -41,25 +80,260 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// Starts a new session, issuing an access and refresh token pair in a new family and
+// recording the client they were issued to. An accessTTL of 0 issues only the refresh
+// token, for callers that issue their own (signed) access tokens.
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, userAgent, clientIP string) (*TokenPair, error) {
+	family := make([]byte, 16)
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	pair, err := insertTokenPair(ctx, tx, userID, family, accessTTL, refreshTTL, userAgent, clientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+// Exchanges a refresh token for a new pair in the same family. Refresh tokens can only
+// be used once: presenting one that has already been rotated means it has leaked, so
+// the whole family is revoked and ErrRefreshTokenReused returned. Unknown or expired
+// tokens return ErrRecordNotFound.
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, userAgent, clientIP string) (*TokenPair, error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	query := `
+		SELECT user_id, family, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+		FOR UPDATE`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID int64
+		family []byte
+		usedAt sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		hashes, err := deleteFamily(ctx, tx, family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		m.invalidateTokens(hashes)
+
+		return nil, ErrRefreshTokenReused
+	}
+
+	// Used refresh tokens are kept, rather than deleted, so that replays can be detected
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := insertTokenPair(ctx, tx, userID, family, accessTTL, refreshTTL, userAgent, clientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+func insertTokenPair(ctx context.Context, db execer, userID int64, family []byte, accessTTL, refreshTTL time.Duration, userAgent, clientIP string) (*TokenPair, error) {
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*Token{refresh}
+
+	var access *Token
+	if accessTTL > 0 {
+		access, err = generateToken(userID, accessTTL, ScopeAuthentication)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, access)
+	}
+
+	for _, token := range tokens {
+		token.UserAgent = userAgent
+		token.ClientIP = clientIP
+		token.Family = family
+
+		err = insertToken(ctx, db, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &TokenPair{Access: access, Refresh: refresh}, nil
+}
+
 func (m TokenModel) Insert(token *Token) error {
-	query := `INSERT INTO tokens(user_id, expiry, hash, scope)
-			  VALUES ($1, $2, $3, $4)
-			  RETURNING user_id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, token)
+}
+
+func insertToken(ctx context.Context, db execer, token *Token) error {
+	query := `INSERT INTO tokens(user_id, expiry, hash, scope, user_agent, client_ip, family)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []any{token.UserID, token.Expiry, token.Hash, token.Scope, token.UserAgent, token.ClientIP, token.Family}
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
 
-	args := []any{token.UserID, token.Expiry, token.Hash, token.Scope}
+// Return the user's sessions, newest first. A session lasts as long as its latest
+// access or unused refresh token, and takes the client details of the latest one. The
+// session belonging to currentToken is flagged so clients can tell which one they are
+// using, it is matched either by token or, for signed access tokens, by family.
+func (m TokenModel) GetSessionsForUser(userID int64, currentToken string, currentFamily []byte) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentToken))
+
+	query := `
+		SELECT max(id), min(created_at), max(last_used_at), max(expiry),
+			(array_agg(user_agent ORDER BY id DESC))[1],
+			(array_agg(client_ip ORDER BY id DESC))[1],
+			bool_or(hash = $4 OR family = $5)
+		FROM tokens
+		WHERE user_id = $1
+		AND (scope = $2 OR (scope = $3 AND used_at IS NULL))
+		AND expiry > NOW()
+		GROUP BY COALESCE(family, hash)
+		ORDER BY min(created_at) DESC, max(id) DESC`
+
+	args := []any{userID, ScopeAuthentication, ScopeRefresh, currentHash[:], currentFamily}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.ClientIP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Delete one of the user's sessions by the id of any of its tokens, along with the rest
+// of its family. The user id is part of the condition so users can only end their own
+// sessions.
+func (m TokenModel) DeleteSession(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		WITH target AS (
+			SELECT hash, family FROM tokens
+			WHERE id = $1 AND user_id = $2 AND scope IN ($3, $4)
+		)
+		DELETE FROM tokens
+		WHERE hash IN (SELECT hash FROM target)
+		OR family IN (SELECT family FROM target)
+		RETURNING hash`
 
+	hashes, err := m.deleteReturningHashes(query, id, userID, ScopeAuthentication, ScopeRefresh)
 	if err != nil {
 		return err
 	}
 
+	if len(hashes) == 0 {
+		return ErrRecordNotFound
+	}
+
 	return nil
 }
 
+// Record that an authentication token has just been used
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `UPDATE tokens SET last_used_at = NOW() WHERE hash = $1 AND scope = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], ScopeAuthentication)
+	return err
+}
+
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 
@@ -67,9 +341,164 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUser(userID)
+
+	return nil
+}
+
+// Delete every expired token. Lookups already ignore them, this just stops them
+// accumulating.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	query := `DELETE FROM tokens WHERE expiry <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Delete a single token along with the rest of its family, for example to log out the
+// session using it
+func (m TokenModel) DeleteForToken(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		WITH target AS (
+			SELECT hash, family FROM tokens WHERE scope = $1 AND hash = $2
+		)
+		DELETE FROM tokens
+		WHERE hash IN (SELECT hash FROM target)
+		OR family IN (SELECT family FROM target)
+		RETURNING hash`
+
+	_, err := m.deleteReturningHashes(query, scope, tokenHash[:])
+	return err
+}
+
+// Count a failed attempt at whatever the token guards, like the code an MFA challenge
+// asks for, and delete the token once it has failed maxFailures times
+func (m TokenModel) RecordFailure(scope, tokenPlaintext string, maxFailures int) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET failures = failures + 1
+		WHERE scope = $1 AND hash = $2
+		RETURNING failures`
+
+	var failures int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, scope, tokenHash[:]).Scan(&failures)
+	if err != nil {
+		switch {
+		//Already used up or deleted by a concurrent attempt
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if failures < maxFailures {
+		return nil
+	}
+
+	_, err = m.deleteReturningHashes(`DELETE FROM tokens WHERE scope = $1 AND hash = $2 RETURNING hash`, scope, tokenHash[:])
+	return err
+}
+
+// Delete every token in one of the user's families, used to end a session whose access
+// token isn't stored
+func (m TokenModel) DeleteFamily(userID int64, family []byte) error {
+	query := `DELETE FROM tokens WHERE user_id = $1 AND family = $2 RETURNING hash`
+
+	_, err := m.deleteReturningHashes(query, userID, family)
 	return err
 }
 
+// Runs a DELETE ... RETURNING hash query and drops the deleted tokens from the cache
+func (m TokenModel) deleteReturningHashes(query string, args ...any) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes, err := scanHashes(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	m.invalidateTokens(hashes)
+
+	return hashes, nil
+}
+
+func deleteFamily(ctx context.Context, tx *sql.Tx, family []byte) ([][]byte, error) {
+	rows, err := tx.QueryContext(ctx, `DELETE FROM tokens WHERE family = $1 RETURNING hash`, family)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanHashes(rows)
+}
+
+func scanHashes(rows *sql.Rows) ([][]byte, error) {
+	var hashes [][]byte
+
+	for rows.Next() {
+		var hash []byte
+
+		err := rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+func (m TokenModel) invalidateTokens(hashes [][]byte) {
+	for _, hash := range hashes {
+		m.Cache.invalidateToken(hash)
+	}
+}
+
+// Delete every token for the user regardless of its scope
+func (m TokenModel) DeleteAllScopesForUser(userID int64) error {
+	query := `DELETE FROM tokens WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUser(userID)
+
+	return nil
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
@@ -0,0 +1,265 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/frankie-mur/greenlight/internal/totp"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+)
+
+// Number of recovery codes issued when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+// A user's TOTP enrollment. The secret has to be stored as is, since codes are
+// computed from it. Until confirmed with a valid code the enrollment has no effect.
+type TOTP struct {
+	UserID       int64
+	CreatedAt    time.Time
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, confirmed, last_used_step
+		FROM users_totp
+		WHERE user_id = $1`
+
+	var t TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&t.CreatedAt,
+		&t.Secret,
+		&t.Confirmed,
+		&t.LastUsedStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Reports whether the user has confirmed two-factor authentication
+func (m TOTPModel) Enabled(userID int64) (bool, error) {
+	t, err := m.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return t.Confirmed, nil
+}
+
+// Start enrolling the user with a new secret, replacing any unconfirmed enrollment.
+// Returns ErrTOTPAlreadyEnabled if the user has a confirmed one.
+func (m TOTPModel) Enroll(userID int64) (*TOTP, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO users_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+		WHERE users_totp.confirmed = false
+		RETURNING created_at`
+
+	t := TOTP{UserID: userID, Secret: secret}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, userID, secret).Scan(&t.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrTOTPAlreadyEnabled
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Check a code against the user's secret. Each time step is only accepted once, so an
+// observed code can't be replayed.
+func (m TOTPModel) VerifyCode(t *TOTP, code string) (bool, error) {
+	step, ok, err := totp.Validate(t.Secret, code, time.Now(), 1)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	query := `
+		UPDATE users_totp
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, t.UserID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Mark the enrollment confirmed and issue a fresh set of recovery codes, returned in
+// plaintext this one time
+func (m TOTPModel) Confirm(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.Sum256([]byte(code))
+		codes[i] = code
+		hashes[i] = hash[:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users_totp SET confirmed = true WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Use up one of the user's recovery codes, reporting whether it was valid and unused
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+	query := `
+		UPDATE totp_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hash[:])
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Turn off two-factor authentication, removing the secret and recovery codes
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Recovery codes look like "abcde-fghij"
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 10)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	return code[:5] + "-" + code[5:10], nil
+}
+
+// Accept codes typed in upper case, or without the dash
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
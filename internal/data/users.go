@@ -5,16 +5,23 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"regexp"
 	"time"
 
+	"github.com/frankie-mur/greenlight/internal/passhash"
 	"github.com/frankie-mur/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 )
 
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// The hasher used for new passwords, set from the command line flags at startup.
+// Existing hashes are verified whatever algorithm they were made with.
+var PasswordHasher passhash.Hasher = &passhash.Argon2id{Params: passhash.DefaultArgon2Params}
+
 // this user is represent as an unauthorized user (req sent from client without Authorization header)
 var AnonymousUser = &User{}
 
@@ -26,6 +33,12 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+
+	// Set while a change of email address is waiting to be confirmed
+	PendingEmail *string `json:"pending_email,omitempty"`
+
+	// The language emails are sent in, such as "en" or "pt-BR"
+	Locale string `json:"locale"`
 }
 
 // The plaintext field is a *pointer* to a string,
@@ -37,7 +50,8 @@ type password struct {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 func (u *User) IsAnonymous() bool {
@@ -48,17 +62,25 @@ func (u *User) IsAnonymous() bool {
 // version fields are all automatically generated by our database, so we use the
 // RETURNING clause to read them into the User struct after the insert.
 func (m UserModel) Insert(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertUser(ctx context.Context, db queryRower, user *User) error {
 	qury := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, locale)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Locale}
 
-	err := m.DB.QueryRowContext(ctx, qury, args...).Scan(
+	err := db.QueryRowContext(ctx, qury, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Version,
@@ -75,10 +97,98 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Insert a new user together with their initial permissions, an activation token and
+// the welcome email, all in one transaction so the email is queued if and only if the
+// user is created. welcome is called with the activation token, once the user's id is
+// known, and returns the email's template and data.
+func (m UserModel) Register(user *User, permissions []string, activationTTL time.Duration, welcome func(token *Token) (string, map[string]any)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(permissions))
+	if err != nil {
+		return err
+	}
+
+	token, err := generateToken(user.ID, activationTTL, ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return err
+	}
+
+	template, data := welcome(token)
+
+	err = insertEmail(ctx, tx, user.Email, user.Locale, template, data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Retrieve the User details from the database based on the user's id.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, version, pending_email, locale
+        FROM users
+        WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.Locale,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, password_hash, activated, version, pending_email, locale
         FROM users
         WHERE email = $1`
 
@@ -95,6 +205,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PendingEmail,
+		&user.Locale,
 	)
 
 	if err != nil {
@@ -110,12 +222,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 // Update the details for a specific user. Notice that we check against the version
-// field to help prevent any race conditions during the request cycle
+// field to help prevent any race conditions during the request cycle. If a new password
+// has been set all of the user's authentication tokens are revoked in the same
+// transaction, so existing sessions can't outlive a password change.
 func (m UserModel) Update(user *User) error {
 	query := `
         UPDATE users 
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5, version = version + 1
+        WHERE id = $6 AND version = $7
         RETURNING version`
 
 	args := []any{
@@ -123,6 +237,7 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
 		user.ID,
 		user.Version,
 	}
@@ -130,7 +245,13 @@ func (m UserModel) Update(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -142,16 +263,333 @@ func (m UserModel) Update(user *User) error {
 		}
 	}
 
+	if user.Password.plaintext != nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope IN ($1, $2) AND user_id = $3`, ScopeAuthentication, ScopeRefresh, user.ID)
+		if err != nil {
+			return err
+		}
+
+		// Signed access tokens aren't stored, so they are revoked by time instead
+		_, err = tx.ExecContext(ctx, `UPDATE users SET tokens_valid_after = $1 WHERE id = $2`, time.Now(), user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// Cached token lookups now hold a stale copy of the user
+	m.Cache.invalidateUser(user.ID)
+
+	return nil
+}
+
+// Delete accounts which were never activated and were created before the given time.
+// Their tokens and permissions go with them through the foreign key cascades.
+func (m UserModel) DeleteUnactivated(createdBefore time.Time) (int64, error) {
+	query := `
+		WITH deleted AS (
+			DELETE FROM users
+			WHERE activated = false AND created_at < $1
+			RETURNING id
+		)
+		INSERT INTO deleted_users (user_id, deleted_at)
+		SELECT id, $2::timestamptz FROM deleted
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, createdBefore, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var deleted int64
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+
+		m.Cache.invalidateUser(id)
+		m.Cache.invalidatePermissions(id)
+		deleted++
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+// Replace the user's password hash with one made by the current hasher, after they have
+// logged in with the plaintext password. Unlike a password change this keeps their
+// sessions, and the version is unchanged since nothing visible has changed. Nothing is
+// updated if the hash was changed in the meantime.
+func (m UserModel) Rehash(user *User, plaintextPassword string) error {
+	// Keep the existing hash if the current hasher can't take the password
+	if max := PasswordHasher.MaxLength(); max > 0 && len(plaintextPassword) > max {
+		return nil
+	}
+
+	hash, err := PasswordHasher.Hash(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE users
+		SET password_hash = $1
+		WHERE id = $2 AND password_hash = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, []byte(hash), user.ID, user.Password.hash)
+	if err != nil {
+		return err
+	}
+
+	user.Password.hash = []byte(hash)
+
+	// Cached token lookups hold a copy of the old hash
+	m.Cache.invalidateUser(user.ID)
+
+	return nil
+}
+
+// Record an email address the user wants to change to. The address has to be free now,
+// though it is checked again on confirmation since it could be taken in the meantime.
+// The user's name and locale are saved in the same statement, so a profile update that
+// also changes the email either applies in full or not at all.
+func (m UserModel) SetPendingEmail(user *User, email string) error {
+	query := `
+		UPDATE users
+		SET name = $1, locale = $2, pending_email = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		AND NOT EXISTS (SELECT 1 FROM users WHERE email = $3)
+		RETURNING version`
+
+	args := []any{
+		user.Name,
+		user.Locale,
+		email,
+		user.ID,
+		user.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Work out which condition failed
+			var taken bool
+			err = m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)`, email).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrDuplicateEmail
+			}
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	user.PendingEmail = &email
+
+	m.Cache.invalidateUser(user.ID)
+
 	return nil
 }
 
+// Swap the user's email for their pending one
+func (m UserModel) ConfirmEmailChange(user *User) error {
+	query := `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, version = version + 1
+		WHERE id = $1 AND pending_email IS NOT NULL
+		RETURNING email, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	user.PendingEmail = nil
+
+	m.Cache.invalidateUser(user.ID)
+
+	return nil
+}
+
+// Delete a user. Their tokens, permissions, roles, reviews and other records are removed
+// by the ON DELETE CASCADE foreign keys.
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	// The deletion is recorded so signed access tokens, which outlive the user row, can
+	// be revoked along with it. The time comes from this server, like the issue time of
+	// the tokens it is compared against.
+	query := `
+		WITH deleted AS (
+			DELETE FROM users WHERE id = $1 RETURNING id
+		)
+		INSERT INTO deleted_users (user_id, deleted_at)
+		SELECT id, $2::timestamptz FROM deleted
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, time.Now()).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	m.Cache.invalidateUser(id)
+	m.Cache.invalidatePermissions(id)
+
+	return nil
+}
+
+// Revoke every signed access token issued to the user up to now, returning the new
+// tokens_valid_after time. The time comes from this server rather than the database,
+// as it is compared with iat claims set from this server's clock.
+func (m UserModel) RevokeSignedTokens(userID int64) (time.Time, error) {
+	query := `
+		UPDATE users
+		SET tokens_valid_after = $1
+		WHERE id = $2
+		RETURNING tokens_valid_after`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var validAfter time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, time.Now(), userID).Scan(&validAfter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	return validAfter, nil
+}
+
+// Return the tokens_valid_after time of every user whose signed tokens were revoked
+// after since, keyed by user id. Users deleted after since are included, every token
+// issued before the deletion is revoked.
+func (m UserModel) GetTokensValidAfter(since time.Time) (map[int64]time.Time, error) {
+	query := `
+		SELECT id, tokens_valid_after
+		FROM users
+		WHERE tokens_valid_after > $1
+		UNION ALL
+		SELECT user_id, deleted_at
+		FROM deleted_users
+		WHERE deleted_at > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	validAfter := make(map[int64]time.Time)
+
+	for rows.Next() {
+		var (
+			id int64
+			t  time.Time
+		)
+
+		err := rows.Scan(&id, &t)
+		if err != nil {
+			return nil, err
+		}
+
+		validAfter[id] = t
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return validAfter, nil
+}
+
+// Forget users deleted before the given time, once any signed tokens they held have
+// expired there's no need to keep revoking them
+func (m UserModel) DeleteDeletedBefore(t time.Time) (int64, error) {
+	query := `DELETE FROM deleted_users WHERE deleted_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 // Get a user given a token
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	// Authentication tokens are looked up on every request so those results are cached
+	cacheable := tokenScope == ScopeAuthentication
+	if cacheable {
+		if user, ok := m.Cache.getUser(tokenHash[:]); ok {
+			return user, nil
+		}
+	}
+
+	// Taken before the read, so a logout that lands while it runs isn't cached over
+	generation := m.Cache.userGeneration()
+
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+            users.pending_email, users.locale, tokens.expiry
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -161,7 +599,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 
-	var user User
+	var (
+		user   User
+		expiry time.Time
+	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -174,6 +615,9 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PendingEmail,
+		&user.Locale,
+		&expiry,
 	)
 	if err != nil {
 		switch {
@@ -184,36 +628,38 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 
+	// Never cache the lookup for longer than the token is valid
+	if cacheable {
+		m.Cache.setUser(generation, tokenHash[:], &user, expiry)
+	}
+
 	// Return the matching user.
 	return &user, nil
 }
 
-// Calculates the bcrypt hash of a plaintext password, stores both in struct
+// Calculates the hash of a plaintext password with the current hasher, stores both in struct
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := PasswordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
 
 	p.plaintext = &plaintextPassword
-	p.hash = hash
+	p.hash = []byte(hash)
 
 	return nil
 }
 
-// Checks if the bcrypt hash of a plaintext password match
+// Checks if a plaintext password matches the stored hash, which may be an Argon2id
+// hash or a bcrypt one from before Argon2id was introduced
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return passhash.Verify(plaintextPassword, string(p.hash))
+}
 
-	return true, nil
+// Reports whether the stored hash was made with an older algorithm or parameters, and
+// should be replaced the next time the plaintext password is known
+func (p *password) NeedsRehash() bool {
+	return PasswordHasher.NeedsRehash(string(p.hash))
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -224,7 +670,26 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= 256, "password", "must not be more than 256 bytes long")
+}
+
+// Validates a password that is about to be hashed. On top of the usual checks it has to
+// fit the current hasher, bcrypt only takes 72 bytes. Logins don't need this, passwords
+// set under another hasher may be longer.
+func ValidateNewPassword(v *validator.Validator, password string) {
+	ValidatePasswordPlaintext(v, password)
+
+	if max := PasswordHasher.MaxLength(); max > 0 {
+		v.Check(len(password) <= max, "password", fmt.Sprintf("must not be more than %d bytes long", max))
+	}
+}
+
+// Locales are a language code, optionally followed by a region, as in "en" or "pt-BR"
+var LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+func ValidateLocale(v *validator.Validator, locale string) {
+	v.Check(locale != "", "locale", "must be provided")
+	v.Check(validator.Matches(locale, LocaleRX), "locale", "must be a language code such as en or pt-BR")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -234,10 +699,12 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
 
+	ValidateLocale(v, user.Locale)
+
 	// If the plaintext password is not nil, call the standalone
-	// ValidatePasswordPlaintext() helper.
+	// ValidateNewPassword() helper.
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPassword(v, *user.Password.plaintext)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
@@ -0,0 +1,251 @@
+// Package jwt signs and verifies compact JSON Web Tokens using HS256 or EdDSA (Ed25519)
+// keys. Keys are held in a Keyring and identified by the token's "kid" header, so new
+// keys can be introduced and old ones retired without invalidating every token at once.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrUnknownKey   = errors.New("unknown key id")
+)
+
+var encoding = base64.RawURLEncoding
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// The registered claims Verify checks regardless of the claims type being decoded into
+type registered struct {
+	ExpiresAt *int64 `json:"exp"`
+	NotBefore *int64 `json:"nbf"`
+}
+
+// Key is a single signing or verification key. An Ed25519 key loaded from a public key
+// can only verify, which is how retired keys are kept around until their tokens expire.
+type Key struct {
+	ID  string
+	Alg string
+
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes", id)
+	}
+
+	return &Key{ID: id, Alg: HS256, secret: secret}, nil
+}
+
+func NewEd25519Key(id string, private ed25519.PrivateKey) *Key {
+	return &Key{ID: id, Alg: EdDSA, private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+func NewEd25519VerifyKey(id string, public ed25519.PublicKey) *Key {
+	return &Key{ID: id, Alg: EdDSA, public: public}
+}
+
+// LoadKey reads a key from a file. HS256 files hold the raw secret, surrounding
+// whitespace is ignored. EdDSA files hold a PEM encoded PKCS #8 private key or PKIX
+// public key.
+func LoadKey(id, alg, path string) (*Key, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch alg {
+	case HS256:
+		return NewHMACKey(id, []byte(strings.TrimSpace(string(contents))))
+	case EdDSA:
+		block, _ := pem.Decode(contents)
+		if block == nil {
+			return nil, fmt.Errorf("jwt: no PEM data in %s", path)
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			private, ok := key.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: %s is not an Ed25519 private key", path)
+			}
+			return NewEd25519Key(id, private), nil
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			public, ok := key.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: %s is not an Ed25519 public key", path)
+			}
+			return NewEd25519VerifyKey(id, public), nil
+		default:
+			return nil, fmt.Errorf("jwt: unexpected PEM block %q in %s", block.Type, path)
+		}
+	default:
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q", alg)
+	}
+}
+
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) sign(signingInput []byte) []byte {
+	if k.Alg == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signingInput)
+		return mac.Sum(nil)
+	}
+
+	return ed25519.Sign(k.private, signingInput)
+}
+
+func (k *Key) verify(signingInput, signature []byte) bool {
+	if k.Alg == HS256 {
+		return hmac.Equal(k.sign(signingInput), signature)
+	}
+
+	return ed25519.Verify(k.public, signingInput, signature)
+}
+
+// Keyring signs with one key and verifies with any of them
+type Keyring struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeyring returns a keyring signing with the key identified by signingID
+func NewKeyring(signingID string, keys ...*Key) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]*Key, len(keys))}
+
+	for _, key := range keys {
+		if _, exists := kr.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.ID)
+		}
+		kr.keys[key.ID] = key
+	}
+
+	kr.signing = kr.keys[signingID]
+	if kr.signing == nil {
+		return nil, fmt.Errorf("jwt: signing key %q: %w", signingID, ErrUnknownKey)
+	}
+	if !kr.signing.CanSign() {
+		return nil, fmt.Errorf("jwt: key %q can only verify", signingID)
+	}
+
+	return kr, nil
+}
+
+// Sign encodes claims as the token payload. The claims should include "exp", tokens
+// without it are rejected by Verify.
+func (kr *Keyring) Sign(claims any) (string, error) {
+	headerJSON, err := json.Marshal(header{Alg: kr.signing.Alg, Typ: "JWT", Kid: kr.signing.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payloadJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(payloadJSON)
+	signature := kr.signing.sign([]byte(signingInput))
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature and expiry, then decodes its payload into claims
+func (kr *Keyring) Verify(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(headerJSON, &h); err != nil {
+		return ErrInvalidToken
+	}
+
+	key := kr.keys[h.Kid]
+	if key == nil {
+		return ErrUnknownKey
+	}
+
+	// The algorithm is fixed by the key, never taken from the token, so a token can't
+	// downgrade itself to "none" or switch an Ed25519 public key into an HMAC secret.
+	if h.Alg != key.Alg {
+		return ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidToken
+	}
+
+	payloadJSON, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var reg registered
+	if err := json.Unmarshal(payloadJSON, &reg); err != nil {
+		return ErrInvalidToken
+	}
+
+	now := time.Now().Unix()
+
+	if reg.ExpiresAt == nil || now >= *reg.ExpiresAt {
+		return ErrExpiredToken
+	}
+	if reg.NotBefore != nil && now < *reg.NotBefore {
+		return ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(payloadJSON, claims); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
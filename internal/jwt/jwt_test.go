@@ -0,0 +1,207 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+func newHMACKey(t *testing.T, id string) *Key {
+	t.Helper()
+
+	key, err := NewHMACKey(id, bytes.Repeat([]byte(id[:1]), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newEd25519Key(t *testing.T, id string) *Key {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewEd25519Key(id, private)
+}
+
+func newKeyring(t *testing.T, signingID string, keys ...*Key) *Keyring {
+	t.Helper()
+
+	kr, err := NewKeyring(signingID, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kr
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, key := range []*Key{newHMACKey(t, "h1"), newEd25519Key(t, "e1")} {
+		t.Run(key.Alg, func(t *testing.T) {
+			kr := newKeyring(t, key.ID, key)
+
+			token, err := kr.Sign(testClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var claims testClaims
+
+			err = kr.Verify(token, &claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "42" {
+				t.Errorf("got subject %q; want %q", claims.Subject, "42")
+			}
+		})
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	kr := newKeyring(t, "h1", newHMACKey(t, "h1"))
+
+	tests := []struct {
+		name   string
+		claims any
+		want   error
+	}{
+		{"expired", testClaims{ExpiresAt: time.Now().Add(-time.Second).Unix()}, ErrExpiredToken},
+		{"no expiry", struct{}{}, ErrExpiredToken},
+		{"not yet valid", testClaims{ExpiresAt: time.Now().Add(time.Hour).Unix(), NotBefore: time.Now().Add(time.Minute).Unix()}, ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := kr.Sign(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var claims testClaims
+
+			err = kr.Verify(token, &claims)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	kr := newKeyring(t, "h1", newHMACKey(t, "h1"))
+
+	token, err := kr.Sign(testClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+
+	payload, err := json.Marshal(testClaims{Subject: "1", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noneHeader, err := json.Marshal(header{Alg: "none", Typ: "JWT", Kid: "h1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"changed payload", parts[0] + "." + encoding.EncodeToString(payload) + "." + parts[2]},
+		{"alg none", encoding.EncodeToString(noneHeader) + "." + parts[1] + "."},
+		{"missing signature", parts[0] + "." + parts[1]},
+		{"garbage", "not.a.token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims testClaims
+
+			if err := kr.Verify(tt.token, &claims); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := newEd25519Key(t, "old")
+	newKey := newHMACKey(t, "new")
+
+	oldKeyring := newKeyring(t, "old", oldKey)
+
+	token, err := oldKeyring.Sign(testClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retired key is kept for verification only
+	retired := NewEd25519VerifyKey("old", oldKey.public)
+	if retired.CanSign() {
+		t.Fatal("a key loaded from a public key can sign")
+	}
+
+	kr := newKeyring(t, "new", newKey, retired)
+
+	var claims testClaims
+
+	err = kr.Verify(token, &claims)
+	if err != nil {
+		t.Fatalf("token signed with the retired key: %v", err)
+	}
+
+	// Once the key is dropped its tokens are no longer accepted
+	kr = newKeyring(t, "new", newKey)
+
+	err = kr.Verify(token, &claims)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got error %v; want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+	private := newEd25519Key(t, "e1")
+
+	tests := []struct {
+		name      string
+		signingID string
+		keys      []*Key
+	}{
+		{"unknown signing key", "missing", []*Key{newHMACKey(t, "h1")}},
+		{"duplicate key id", "h1", []*Key{newHMACKey(t, "h1"), newHMACKey(t, "h1")}},
+		{"verify only signing key", "e1", []*Key{NewEd25519VerifyKey("e1", private.public)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyring(tt.signingID, tt.keys...); err == nil {
+				t.Error("NewKeyring succeeded; want an error")
+			}
+		})
+	}
+
+	if _, err := NewHMACKey("short", make([]byte, 31)); err == nil {
+		t.Error("NewHMACKey succeeded with a 31 byte secret")
+	}
+}
@@ -0,0 +1,175 @@
+package mailer
+
+import (
+	"encoding/json"
+	"io/fs"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The locale of the unsuffixed templates, used when there is no translation
+const DefaultLocale = "en"
+
+// Locales with at least one translated template, found from the embedded file names,
+// e.g. templates/user_welcome.es.tmpl adds "es"
+var supportedLocales = findLocales()
+
+func findLocales() []string {
+	locales := []string{DefaultLocale}
+
+	fs.WalkDir(templateFS, "templates", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		parts := strings.Split(d.Name(), ".")
+		if len(parts) == 3 && !slices.Contains(locales, parts[1]) {
+			locales = append(locales, parts[1])
+		}
+
+		return nil
+	})
+
+	sort.Strings(locales[1:])
+
+	return locales
+}
+
+// Locales returns the locales emails are translated into, the default first
+func Locales() []string {
+	return slices.Clone(supportedLocales)
+}
+
+// The locales to try for a template, most specific first: "pt-BR" tries "pt-BR" then "pt".
+// The default locale isn't included since it has no suffix.
+func fallbacks(locale string) []string {
+	var chain []string
+
+	if locale != "" && locale != DefaultLocale {
+		chain = append(chain, locale)
+	}
+
+	if lang, _, found := strings.Cut(locale, "-"); found && lang != DefaultLocale {
+		chain = append(chain, lang)
+	}
+
+	return chain
+}
+
+// NegotiateLocale picks the supported locale that best matches an Accept-Language
+// header, or the default locale if none do
+func NegotiateLocale(acceptLanguage string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+
+	var choices []choice
+
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if q > 0 {
+			choices = append(choices, choice{tag: tag, q: q})
+		}
+	}
+
+	// Highest quality first, keeping the header's order for equal ones
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		lang, region, hasRegion := strings.Cut(c.tag, "-")
+		lang = strings.ToLower(lang)
+
+		if hasRegion {
+			full := lang + "-" + strings.ToUpper(region)
+			if slices.Contains(supportedLocales, full) {
+				return full
+			}
+		}
+
+		if slices.Contains(supportedLocales, lang) {
+			return lang
+		}
+	}
+
+	return DefaultLocale
+}
+
+// Unit names for formatting durations, singular then plural
+var durationUnits = map[string][3][2]string{
+	"en": {{"day", "days"}, {"hour", "hours"}, {"minute", "minutes"}},
+	"es": {{"día", "días"}, {"hora", "horas"}, {"minuto", "minutos"}},
+}
+
+var durationConjunctions = map[string]string{
+	"en": "and",
+	"es": "y",
+}
+
+// Format a duration in whole days, hours and minutes, such as "3 days" or "1 hour and
+// 30 minutes". Templates call it as {{duration .tokenTTL}}. The duration may also be a
+// number of nanoseconds, which is what a time.Duration becomes once stored as JSON.
+func formatDuration(locale string, value any) string {
+	var d time.Duration
+
+	switch v := value.(type) {
+	case time.Duration:
+		d = v
+	case int64:
+		d = time.Duration(v)
+	case int:
+		d = time.Duration(v)
+	case float64:
+		d = time.Duration(v)
+	case json.Number:
+		n, _ := v.Int64()
+		d = time.Duration(n)
+	}
+
+	units, ok := durationUnits[locale]
+	if !ok {
+		units = durationUnits[DefaultLocale]
+	}
+	and, ok := durationConjunctions[locale]
+	if !ok {
+		and = durationConjunctions[DefaultLocale]
+	}
+
+	minutes := int(d.Round(time.Minute) / time.Minute)
+	counts := [3]int{minutes / (24 * 60), minutes / 60 % 24, minutes % 60}
+
+	var parts []string
+	for i, n := range counts {
+		switch {
+		case n == 1:
+			parts = append(parts, "1 "+units[i][0])
+		case n > 1:
+			parts = append(parts, strconv.Itoa(n)+" "+units[i][1])
+		}
+	}
+
+	switch len(parts) {
+	case 0:
+		return "0 " + units[2][1]
+	case 1:
+		return parts[0]
+	default:
+		return strings.Join(parts[:len(parts)-1], ", ") + " " + and + " " + parts[len(parts)-1]
+	}
+}
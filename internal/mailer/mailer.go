@@ -3,10 +3,9 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"io/fs"
+	"strings"
 	"text/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
 )
 
 //Want to embed our template to make it apart of our binary
@@ -14,27 +13,39 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// A rendered email, ready to be delivered by a Transport
+type Message struct {
+	To        string
+	From      string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
 }
 
-// Create a instance of a Mailer with 5 second timesout
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// Transport delivers rendered messages, see SMTPTransport, FileTransport, LogTransport
+// and Recorder
+type Transport interface {
+	Deliver(msg *Message) error
+}
 
+// Mailer renders emails from the embedded templates and hands them to its transport
+type Mailer struct {
+	transport Transport
+	sender    string
+}
+
+// Create a Mailer sending from sender through the given transport
+func New(transport Transport, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
 	}
 }
 
-// Send a email to a recipient, function also parses all templates
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	// Use the ParseFS() method to parse the required template file from the embedded
-	// file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// Send a email to a recipient in their locale, falling back to English for templates
+// which haven't been translated
+func (m Mailer) Send(recipient, locale, templateFile string, data any) error {
+	tmpl, err := parseTemplate(locale, templateFile)
 	if err != nil {
 		return err
 	}
@@ -56,25 +67,54 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	if err != nil {
 		return err
 	}
-	//Create a new message object setting all fields
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	// Try sending the email up to three times before aborting
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		// If everything worked, return nil.
-		if nil == err {
-			return nil
+
+	return m.transport.Deliver(&Message{
+		To:        recipient,
+		From:      m.sender,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	})
+}
+
+// Parse the template for the first locale it has been translated into, along with the
+// shared layout and that locale's partials. Templates are looked up as name.<locale>.tmpl,
+// with the unsuffixed name.tmpl in the default locale.
+func parseTemplate(locale, templateFile string) (*template.Template, error) {
+	name := strings.TrimSuffix(templateFile, ".tmpl")
+
+	resolved, file := DefaultLocale, templateFile
+	for _, l := range fallbacks(locale) {
+		candidate := name + "." + l + ".tmpl"
+		if _, err := fs.Stat(templateFS, "templates/"+candidate); err == nil {
+			resolved, file = l, candidate
+			break
+		}
+	}
+
+	files := []string{"templates/layouts/base.tmpl"}
+	if resolved != DefaultLocale {
+		if _, err := fs.Stat(templateFS, "templates/layouts/base."+resolved+".tmpl"); err == nil {
+			files = append(files, "templates/layouts/base."+resolved+".tmpl")
 		}
+	}
+	files = append(files, "templates/"+file)
+
+	funcs := template.FuncMap{
+		"locale":   func() string { return resolved },
+		"duration": func(d any) string { return formatDuration(resolved, d) },
+	}
 
-		// If it didn't work, sleep for a short time and retry.
-		time.Sleep(500 * time.Millisecond)
+	// Later files redefine the blocks of earlier ones, so partials are overridden by
+	// the locale's own
+	tmpl := template.New("email").Funcs(funcs)
+	for _, f := range files {
+		var err error
+		tmpl, err = tmpl.ParseFS(templateFS, f)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	return tmpl, nil
 }
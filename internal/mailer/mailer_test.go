@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		locale   string
+		subject  string
+		lang     string
+		duration string
+	}{
+		{"default locale", "en", "Welcome to Greenlight!", `lang="en"`, "3 days"},
+		{"translated", "es", "¡Te damos la bienvenida a Greenlight!", `lang="es"`, "3 días"},
+		{"region falls back to language", "es-MX", "¡Te damos la bienvenida a Greenlight!", `lang="es"`, "3 días"},
+		{"untranslated falls back to default", "fr", "Welcome to Greenlight!", `lang="en"`, "3 days"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewRecorder()
+			m := New(recorder, "Greenlight <no-reply@greenlight.net>")
+
+			err := m.Send("alice@example.com", tt.locale, "user_welcome.tmpl", map[string]any{
+				"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+				"userID":          42,
+				"tokenTTL":        72 * time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := recorder.MessagesTo("alice@example.com")
+			if len(messages) != 1 {
+				t.Fatalf("got %d messages; want 1", len(messages))
+			}
+
+			msg := messages[0]
+
+			if msg.From != "Greenlight <no-reply@greenlight.net>" {
+				t.Errorf("got from %q", msg.From)
+			}
+			if msg.Subject != tt.subject {
+				t.Errorf("got subject %q; want %q", msg.Subject, tt.subject)
+			}
+
+			for _, body := range []string{msg.PlainBody, msg.HTMLBody} {
+				if !strings.Contains(body, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+					t.Errorf("body is missing the token:\n%s", body)
+				}
+				if !strings.Contains(body, tt.duration) {
+					t.Errorf("body is missing %q:\n%s", tt.duration, body)
+				}
+			}
+
+			if !strings.Contains(msg.HTMLBody, tt.lang) {
+				t.Errorf("html body is missing %s", tt.lang)
+			}
+		})
+	}
+}
+
+// Template data read back from the outbox has durations as json.Number
+func TestSendDecodedData(t *testing.T) {
+	recorder := NewRecorder()
+	m := New(recorder, "Greenlight <no-reply@greenlight.net>")
+
+	err := m.Send("alice@example.com", "en", "token_password_reset.tmpl", map[string]any{
+		"passwordResetToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"tokenTTL":           json.Number("2700000000000"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := recorder.Messages()[0]
+	if !strings.Contains(msg.PlainBody, "45 minutes") {
+		t.Errorf("body is missing the duration:\n%s", msg.PlainBody)
+	}
+}
+
+func TestSendTransportError(t *testing.T) {
+	recorder := NewRecorder()
+	m := New(recorder, "Greenlight <no-reply@greenlight.net>")
+
+	errDown := errors.New("mail server down")
+	recorder.SetErr(errDown)
+
+	err := m.Send("alice@example.com", "en", "email_change_notice.tmpl", map[string]any{"newEmail": "bob@example.com"})
+	if !errors.Is(err, errDown) {
+		t.Fatalf("got error %v; want %v", err, errDown)
+	}
+	if n := len(recorder.Messages()); n != 0 {
+		t.Fatalf("got %d messages; want 0", n)
+	}
+
+	recorder.SetErr(nil)
+
+	err = m.Send("alice@example.com", "en", "email_change_notice.tmpl", map[string]any{"newEmail": "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(recorder.Messages()); n != 1 {
+		t.Fatalf("got %d messages; want 1", n)
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	m := New(NewRecorder(), "Greenlight <no-reply@greenlight.net>")
+
+	if err := m.Send("alice@example.com", "en", "missing.tmpl", nil); err == nil {
+		t.Error("Send succeeded with a template that doesn't exist")
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"es", "es"},
+		{"es-MX,es;q=0.9", "es"},
+		{"fr-FR,fr;q=0.9,es;q=0.8", "es"},
+		{"de;q=0.9,es;q=0", "en"},
+		{"en;q=0.5,es;q=0.8", "es"},
+	}
+
+	for _, tt := range tests {
+		if got := NegotiateLocale(tt.header); got != tt.want {
+			t.Errorf("NegotiateLocale(%q) = %q; want %q", tt.header, got, tt.want)
+		}
+	}
+}
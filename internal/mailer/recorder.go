@@ -0,0 +1,65 @@
+package mailer
+
+import "sync"
+
+// Recorder keeps delivered messages in memory so tests can check what was sent
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+	err      error
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Deliver(msg *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	r.messages = append(r.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of the messages delivered so far, oldest first
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Message(nil), r.messages...)
+}
+
+// MessagesTo returns the messages delivered to one recipient, oldest first
+func (r *Recorder) MessagesTo(recipient string) []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []Message
+	for _, msg := range r.messages {
+		if msg.To == recipient {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// SetErr makes further deliveries fail with err, or succeed again if err is nil
+func (r *Recorder) SetErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.err = err
+}
+
+// Reset forgets all delivered messages
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages = nil
+}
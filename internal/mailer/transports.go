@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// SMTPTransport sends messages through an SMTP server
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+// Create a SMTP transport with a 5 second timeout
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+func (t *SMTPTransport) Deliver(msg *Message) error {
+	m := newMailMessage(msg)
+
+	// Try sending the email up to three times before aborting
+	var err error
+	for i := 1; i <= 3; i++ {
+		err = t.dialer.DialAndSend(m)
+		// If everything worked, return nil.
+		if nil == err {
+			return nil
+		}
+
+		// If it didn't work, sleep for a short time and retry.
+		if i < 3 {
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	// Return the last error so the caller knows the email wasn't sent
+	return err
+}
+
+// FileTransport writes each message to its own .eml file in a directory, where it can
+// be opened with any mail client. Useful for local development.
+type FileTransport struct {
+	dir string
+}
+
+// Create a file transport, creating the directory if needed
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Deliver(msg *Message) error {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	// Name files by time so they list in the order they were sent
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000"), hex.EncodeToString(suffix))
+
+	f, err := os.OpenFile(filepath.Join(t.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = newMailMessage(msg).WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LogTransport logs messages instead of sending them, including the plain text body
+// so links and tokens can be copied out of the log. Not for use in production.
+type LogTransport struct {
+	logger *slog.Logger
+}
+
+func NewLogTransport(logger *slog.Logger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+func (t *LogTransport) Deliver(msg *Message) error {
+	t.logger.Info("email", "to", msg.To, "from", msg.From, "subject", msg.Subject, "body", msg.PlainBody)
+	return nil
+}
+
+func newMailMessage(msg *Message) *mail.Message {
+	//Create a new message object setting all fields
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
+}
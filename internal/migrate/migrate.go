@@ -0,0 +1,344 @@
+// Package migrate applies the SQL migrations embedded in the binary. Applied versions
+// are recorded in the same schema_migrations table (and guarded by the same advisory
+// lock) as the golang-migrate CLI, so the two can be used interchangeably.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDirty          = errors.New("database schema is dirty, a previous migration failed and must be fixed by hand")
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// Same salt that golang-migrate uses to derive its advisory lock id
+const advisoryLockIDSalt = 1486364155
+
+var filenameRX = regexp.MustCompile(`^([0-9]+)_(.*)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	// Version is the currently applied version, 0 if no migrations have been applied
+	Version uint
+	Dirty   bool
+	Latest  uint
+	Pending []Migration
+}
+
+// Behind reports whether there are migrations that haven't been applied yet
+func (s Status) Behind() bool {
+	return len(s.Pending) > 0
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// Create a Migrator for the migration files in the root of fsys. Files must follow the
+// golang-migrate naming convention {version}_{name}.up.sql / {version}_{name}.down.sql
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+
+	for _, entry := range entries {
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+
+		contents, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: matches[2]}
+			byVersion[uint(version)] = migration
+		}
+
+		if matches[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	m := &Migrator{db: db}
+	for _, migration := range byVersion {
+		m.migrations = append(m.migrations, *migration)
+	}
+
+	slices.SortFunc(m.migrations, func(a, b Migration) int {
+		return int(a.Version) - int(b.Version)
+	})
+
+	return m, nil
+}
+
+// Return the applied version and pending migrations. This doesn't take the lock so it
+// is cheap enough to run on every start up.
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	version, dirty, err := currentVersion(ctx, m.db)
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{Version: version, Dirty: dirty}
+
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+
+	if len(m.migrations) > 0 {
+		status.Latest = m.migrations[len(m.migrations)-1].Version
+	}
+
+	return status, nil
+}
+
+// Apply the next n up migrations, or all of them if n <= 0
+func (m *Migrator) Up(ctx context.Context, n int) error {
+	return m.withLock(ctx, func(conn *sql.Conn, version uint) error {
+		applied := 0
+
+		for _, migration := range m.migrations {
+			if migration.Version <= version {
+				continue
+			}
+			if n > 0 && applied == n {
+				break
+			}
+
+			err := m.apply(ctx, conn, migration.Up, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+			}
+
+			applied++
+		}
+
+		return nil
+	})
+}
+
+// Roll back the last n applied migrations, or all of them if n <= 0
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.withLock(ctx, func(conn *sql.Conn, version uint) error {
+		reverted := 0
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+
+			if migration.Version > version {
+				continue
+			}
+			if n > 0 && reverted == n {
+				break
+			}
+
+			// After rolling back we are at the version of the previous migration
+			var previous uint
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+
+			err := m.apply(ctx, conn, migration.Down, previous)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+			}
+
+			reverted++
+		}
+
+		return nil
+	})
+}
+
+// Migrate up or down until the database is at the given version, 0 rolls back
+// everything
+func (m *Migrator) Goto(ctx context.Context, target uint) error {
+	if target != 0 && !slices.ContainsFunc(m.migrations, func(mig Migration) bool { return mig.Version == target }) {
+		return ErrUnknownVersion
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	steps := 0
+	for _, migration := range m.migrations {
+		switch {
+		case status.Version < target && migration.Version > status.Version && migration.Version <= target:
+			steps++
+		case status.Version > target && migration.Version > target && migration.Version <= status.Version:
+			steps++
+		}
+	}
+
+	if steps == 0 {
+		return nil
+	}
+	if status.Version < target {
+		return m.Up(ctx, steps)
+	}
+
+	return m.Down(ctx, steps)
+}
+
+// Run fn while holding the golang-migrate compatible advisory lock on a dedicated
+// connection, session level advisory locks belong to a single connection.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, version uint) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockID, err := advisoryLockID(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Use a fresh context so the lock is released even if ctx has been cancelled
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn.ExecContext(unlockCtx, `SELECT pg_advisory_unlock($1)`, lockID)
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	// Read the version only once we hold the lock, another instance may have just
+	// finished migrating
+	version, dirty, err := currentVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return ErrDirty
+	}
+
+	return fn(conn, version)
+}
+
+// Run a migration script and record the resulting version in a single transaction,
+// so a failure leaves both the schema and schema_migrations untouched
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script string, version uint) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if strings.TrimSpace(script) != "" {
+		_, err = tx.ExecContext(ctx, script)
+		if err != nil {
+			return err
+		}
+	}
+
+	// golang-migrate keeps a single row, and no rows at all once everything has been
+	// rolled back
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version > 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func currentVersion(ctx context.Context, q queryer) (uint, bool, error) {
+	var exists bool
+
+	err := q.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err = q.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	// golang-migrate uses -1 for "no version"
+	if version < 0 {
+		return 0, dirty, nil
+	}
+
+	return uint(version), dirty, nil
+}
+
+// Derive the advisory lock id the same way golang-migrate's postgres driver does, from
+// the database, schema and migrations table names
+func advisoryLockID(ctx context.Context, q queryer) (string, error) {
+	var database, schema string
+
+	err := q.QueryRowContext(ctx, `SELECT current_database(), current_schema()`).Scan(&database, &schema)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.Join([]string{schema, "schema_migrations", database}, "\x00")
+	sum := crc32.ChecksumIEEE([]byte(name)) * uint32(advisoryLockIDSalt)
+
+	return fmt.Sprint(sum), nil
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/frankie-mur/greenlight/migrations"
+)
+
+func TestNew(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000010_add_index.up.sql":    {Data: []byte("CREATE INDEX i ON t (c);")},
+		"000010_add_index.down.sql":  {Data: []byte("DROP INDEX i;")},
+		"000002_create_t.up.sql":     {Data: []byte("CREATE TABLE t (c int);")},
+		"000002_create_t.down.sql":   {Data: []byte("DROP TABLE t;")},
+		"000001_noop.up.sql":         {Data: []byte("")},
+		"README.md":                  {Data: []byte("not a migration")},
+		"000003_sideways.left.sql":   {Data: []byte("not a migration either")},
+		"000004_folder.up.sql/x.sql": {Data: []byte("inside a directory")},
+	}
+
+	m, err := New(nil, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Migration{
+		{Version: 1, Name: "noop"},
+		{Version: 2, Name: "create_t", Up: "CREATE TABLE t (c int);", Down: "DROP TABLE t;"},
+		{Version: 10, Name: "add_index", Up: "CREATE INDEX i ON t (c);", Down: "DROP INDEX i;"},
+	}
+
+	if len(m.migrations) != len(want) {
+		t.Fatalf("got %d migrations; want %d", len(m.migrations), len(want))
+	}
+
+	for i, got := range m.migrations {
+		if got != want[i] {
+			t.Errorf("migration %d = %+v; want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestNewInvalidVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"99999999999999999999_too_big.up.sql": {Data: []byte("SELECT 1;")},
+	}
+
+	if _, err := New(nil, fsys); err == nil {
+		t.Error("New succeeded with a version that doesn't fit in a uint64")
+	}
+}
+
+// Every embedded migration must be reversible for `migrate down` and `migrate goto`
+func TestEmbeddedMigrations(t *testing.T) {
+	m, err := New(nil, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, migration := range m.migrations {
+		if migration.Version != uint(i+1) {
+			t.Errorf("migration %d_%s: want version %d, versions should have no gaps", migration.Version, migration.Name, i+1)
+		}
+		if migration.Up == "" {
+			t.Errorf("migration %d_%s has no up script", migration.Version, migration.Name)
+		}
+		if migration.Down == "" {
+			t.Errorf("migration %d_%s has no down script", migration.Version, migration.Name)
+		}
+	}
+}
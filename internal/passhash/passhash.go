@@ -0,0 +1,213 @@
+// Package passhash hashes passwords into self-describing strings. New hashes use the
+// PHC string format, so the algorithm and its parameters are stored with each hash and
+// can be changed without invalidating existing passwords. Bcrypt hashes in their own
+// modular crypt format are still verified.
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownFormat = errors.New("passhash: unrecognised hash format")
+
+// PHC strings use unpadded standard base64
+var encoding = base64.RawStdEncoding
+
+// Hasher creates hashes for new passwords
+type Hasher interface {
+	Hash(plaintext string) (string, error)
+
+	// NeedsRehash reports whether an existing hash was made with a different algorithm
+	// or different parameters than this hasher would use now
+	NeedsRehash(encoded string) bool
+
+	// MaxLength is the longest password in bytes the hasher accepts, 0 means any length
+	MaxLength() int
+}
+
+// Verify checks a plaintext password against a hash made by any supported hasher
+func Verify(plaintext, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plaintext))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+
+		return true, nil
+	default:
+		return false, ErrUnknownFormat
+	}
+}
+
+// Argon2Params are the tunable Argon2id parameters, Memory is in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation of at least 19 MiB of memory,
+// with extra memory and passes since this runs once per login
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type Argon2id struct {
+	Params Argon2Params
+}
+
+func NewArgon2id(params Argon2Params) (*Argon2id, error) {
+	switch {
+	case params.Memory < 8*uint32(params.Parallelism):
+		return nil, fmt.Errorf("passhash: argon2id memory must be at least 8 KiB per thread")
+	case params.Iterations < 1:
+		return nil, fmt.Errorf("passhash: argon2id iterations must be at least 1")
+	case params.Parallelism < 1:
+		return nil, fmt.Errorf("passhash: argon2id parallelism must be at least 1")
+	case params.SaltLength < 8:
+		return nil, fmt.Errorf("passhash: argon2id salt must be at least 8 bytes")
+	case params.KeyLength < 16:
+		return nil, fmt.Errorf("passhash: argon2id key must be at least 16 bytes")
+	}
+
+	return &Argon2id{Params: params}, nil
+}
+
+// Hash returns a hash like $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func (h *Argon2id) Hash(plaintext string) (string, error) {
+	p := h.Params
+
+	salt := make([]byte, p.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != h.Params.Memory ||
+		params.Iterations != h.Params.Iterations ||
+		params.Parallelism != h.Params.Parallelism ||
+		uint32(len(salt)) < h.Params.SaltLength ||
+		uint32(len(key)) != h.Params.KeyLength
+}
+
+func (h *Argon2id) MaxLength() int {
+	return 0
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	// The leading $ gives an empty first field
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, ErrUnknownFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, fmt.Errorf("passhash: unsupported argon2 version %q", fields[2])
+	}
+
+	var params Argon2Params
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || params.Iterations < 1 || params.Parallelism < 1 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("passhash: invalid argon2id parameters %q", fields[3])
+	}
+
+	salt, err := encoding.DecodeString(fields[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("passhash: invalid argon2id salt: %w", err)
+	}
+
+	key, err := encoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("passhash: invalid argon2id key")
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// Bcrypt is kept for existing hashes. It only uses the first 72 bytes of a password
+// and refuses longer ones, so it shouldn't be used for new passwords.
+type Bcrypt struct {
+	Cost int
+}
+
+func NewBcrypt(cost int) (*Bcrypt, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("passhash: bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	return &Bcrypt{Cost: cost}, nil
+}
+
+func (h *Bcrypt) Hash(plaintext string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (h *Bcrypt) NeedsRehash(encoded string) bool {
+	if !isBcrypt(encoded) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Bcrypt refuses passwords longer than 72 bytes rather than ignoring the rest
+func (h *Bcrypt) MaxLength() int {
+	return 72
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
@@ -0,0 +1,182 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Small parameters so the tests run quickly
+var testParams = Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestArgon2id(t *testing.T) {
+	h, err := NewArgon2id(testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := h.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "$argon2id$v=19$m=64,t=1,p=1$"; !strings.HasPrefix(encoded, want) {
+		t.Fatalf("got hash %q; want prefix %q", encoded, want)
+	}
+
+	other, err := h.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == encoded {
+		t.Error("hashing the same password twice gave the same hash, salts should differ")
+	}
+
+	checkVerify(t, encoded, "pa55word1234", true)
+	checkVerify(t, encoded, "pa55word1235", false)
+
+	if h.NeedsRehash(encoded) {
+		t.Error("NeedsRehash = true for a hash made with the same parameters")
+	}
+	if h.MaxLength() != 0 {
+		t.Errorf("MaxLength = %d; want 0", h.MaxLength())
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	h, err := NewArgon2id(testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := h.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := testParams
+	stronger.Iterations = 2
+
+	h2, err := NewArgon2id(stronger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h2.NeedsRehash(encoded) {
+		t.Error("NeedsRehash = false after the iterations changed")
+	}
+
+	b, err := NewBcrypt(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.NeedsRehash(encoded) {
+		t.Error("bcrypt NeedsRehash = false for an argon2id hash")
+	}
+}
+
+func TestNewArgon2idInvalidParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *Argon2Params)
+	}{
+		{"too little memory", func(p *Argon2Params) { p.Memory = 4 }},
+		{"no iterations", func(p *Argon2Params) { p.Iterations = 0 }},
+		{"no parallelism", func(p *Argon2Params) { p.Parallelism = 0 }},
+		{"short salt", func(p *Argon2Params) { p.SaltLength = 4 }},
+		{"short key", func(p *Argon2Params) { p.KeyLength = 8 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := testParams
+			tt.modify(&params)
+
+			if _, err := NewArgon2id(params); err == nil {
+				t.Error("NewArgon2id succeeded; want an error")
+			}
+		})
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	h, err := NewBcrypt(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := h.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVerify(t, encoded, "pa55word1234", true)
+	checkVerify(t, encoded, "pa55word1235", false)
+
+	if h.NeedsRehash(encoded) {
+		t.Error("NeedsRehash = true for a hash made with the same cost")
+	}
+
+	h2, err := NewBcrypt(bcrypt.MinCost + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h2.NeedsRehash(encoded) {
+		t.Error("NeedsRehash = false after the cost changed")
+	}
+
+	if _, err := NewBcrypt(bcrypt.MaxCost + 1); err == nil {
+		t.Error("NewBcrypt succeeded with too high a cost")
+	}
+}
+
+func TestBcryptMaxLength(t *testing.T) {
+	h, err := NewBcrypt(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.MaxLength() != 72 {
+		t.Fatalf("MaxLength = %d; want 72", h.MaxLength())
+	}
+
+	_, err = h.Hash(strings.Repeat("a", 72))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Hash(strings.Repeat("a", 73))
+	if !errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		t.Fatalf("got error %v; want %v", err, bcrypt.ErrPasswordTooLong)
+	}
+}
+
+func TestVerifyUnknownFormat(t *testing.T) {
+	for _, encoded := range []string{"", "plaintext", "$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA", "$argon2id$v=19$m=64,t=1,p=1$bad"} {
+		_, err := Verify("pa55word1234", encoded)
+		if err == nil {
+			t.Errorf("Verify(%q) succeeded; want an error", encoded)
+		}
+	}
+}
+
+func checkVerify(t *testing.T, encoded, plaintext string, want bool) {
+	t.Helper()
+
+	got, err := Verify(plaintext, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Verify(%q) = %v; want %v", plaintext, got, want)
+	}
+}
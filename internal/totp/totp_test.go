@@ -0,0 +1,154 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 seed from RFC 6238 appendix B, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B test vectors, truncated to the 6 digits used here
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("Code at %d = %s; want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	got, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "287082" {
+		t.Errorf("got %s; want 287082", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name     string
+		step     int64
+		skew     int
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", current, 1, current, true},
+		{"previous step within skew", current - 1, 1, current - 1, true},
+		{"next step within skew", current + 1, 1, current + 1, true},
+		{"outside skew", current - 2, 1, 0, false},
+		{"no skew", current - 1, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok, err := Validate(rfcSecret, code, now, tt.skew)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("Validate = %d, %v; want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		_, ok, err := Validate(rfcSecret, code, time.Now(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("Validate(%q) = true; want false", code)
+		}
+	}
+
+	if _, _, err := Validate("not base32!", "123456", time.Now(), 1); err == nil {
+		t.Error("Validate succeeded with an invalid secret")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 160 bits is 32 base32 characters without padding
+	if len(secret) != 32 {
+		t.Errorf("got a %d character secret; want 32", len(secret))
+	}
+
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == secret {
+		t.Error("GenerateSecret returned the same secret twice")
+	}
+
+	if _, err := Code(secret, 1); err != nil {
+		t.Errorf("generated secret can't be used: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Greenlight", "alice@example.com", rfcSecret)
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("got %s://%s; want otpauth://totp", u.Scheme, u.Host)
+	}
+	if u.Path != "/Greenlight:alice@example.com" {
+		t.Errorf("got label %q", u.Path)
+	}
+
+	q := u.Query()
+	for key, want := range map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Greenlight",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	} {
+		if got := q.Get(key); got != want {
+			t.Errorf("%s = %q; want %q", key, got, want)
+		}
+	}
+}
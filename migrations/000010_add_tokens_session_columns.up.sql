@@ -0,0 +1,5 @@
+ALTER TABLE tokens ADD COLUMN id bigserial UNIQUE NOT NULL;
+ALTER TABLE tokens ADD COLUMN created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN user_agent text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN client_ip text NOT NULL DEFAULT '';
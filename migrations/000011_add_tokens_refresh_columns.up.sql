@@ -0,0 +1,3 @@
+ALTER TABLE tokens ADD COLUMN family bytea;
+ALTER TABLE tokens ADD COLUMN used_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
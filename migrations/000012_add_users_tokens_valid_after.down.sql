@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_tokens_valid_after_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS tokens_valid_after;
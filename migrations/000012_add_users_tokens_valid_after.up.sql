@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN tokens_valid_after timestamp with time zone;
+CREATE INDEX IF NOT EXISTS users_tokens_valid_after_idx ON users (tokens_valid_after);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    kind text NOT NULL,
+    payload jsonb NOT NULL DEFAULT '{}',
+    priority integer NOT NULL DEFAULT 0,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL DEFAULT 5,
+    backoff_seconds integer NOT NULL DEFAULT 30,
+    run_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_error text,
+    finished_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs (priority DESC, run_at) WHERE status = 'pending';
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS scheduled_runs (
+    id bigserial PRIMARY KEY,
+    task text NOT NULL,
+    started_at timestamp(0) with time zone NOT NULL,
+    finished_at timestamp(0) with time zone NOT NULL,
+    succeeded boolean NOT NULL,
+    rows_affected bigint NOT NULL DEFAULT 0,
+    error text
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_runs_task_idx ON scheduled_runs (task, started_at DESC);
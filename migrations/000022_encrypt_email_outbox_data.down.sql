@@ -0,0 +1,2 @@
+ALTER TABLE email_outbox DROP COLUMN IF EXISTS data;
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS data jsonb NOT NULL DEFAULT '{}';
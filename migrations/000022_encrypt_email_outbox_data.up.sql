@@ -0,0 +1,5 @@
+-- Template data is encrypted by the api from now on. The data of emails still waiting
+-- to be sent can't be carried over, so they are marked dead.
+UPDATE email_outbox SET status = 'dead', last_error = 'template data discarded when outbox encryption was enabled' WHERE status = 'pending';
+ALTER TABLE email_outbox DROP COLUMN IF EXISTS data;
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS data bytea;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS deleted_users (
+    user_id bigint PRIMARY KEY,
+    deleted_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS deleted_users_deleted_at_idx ON deleted_users (deleted_at);
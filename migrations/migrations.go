@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migration files so that they ship inside the api
+// binary and can be applied with `api migrate up`.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS